@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/tidwall/buntdb"
+)
+
+// AuditEntry records one command. Entries are only ever added, under
+// audit:<unix nanoseconds>:<sequence> so keys sort chronologically, and are
+// never changed or deleted by the bot.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	UserID   int64     `json:"user_id"`
+	Username string    `json:"username"`
+	Command  string    `json:"command"`
+	Args     string    `json:"args,omitempty"`
+	Result   string    `json:"result"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+const (
+	auditDefaultLimit = 20
+	auditMaxLimit     = 200
+	auditDetailLength = 200
+)
+
+var auditSequence atomic.Uint64
+
+func auditKey(t time.Time) string {
+	return fmt.Sprintf("audit:%020d:%06d", t.UnixNano(), auditSequence.Add(1)%1000000)
+}
+
+// auditKeyBound returns the smallest key of entries recorded at or after t.
+func auditKeyBound(t time.Time) string {
+	return fmt.Sprintf("audit:%020d", t.UnixNano())
+}
+
+// isReadOnlyCommand reports whether a command never changes any state. These
+// are only audited when they are refused.
+func isReadOnlyCommand(command string) bool {
+	switch command {
+	case "start", "help", "guide", "whoami", "admin", "jobs", "getdomains", "getredirects", "roles":
+		return true
+	default:
+		return false
+	}
+}
+
+// redactCommandArgs removes credentials from command arguments before they
+// are written to the audit log.
+func redactCommandArgs(command, args string) string {
+	switch command {
+	case "setverceltoken", "setcloudflaretoken", "setnetlifytoken":
+		if args == "" {
+			return ""
+		}
+		return "[redacted]"
+	case "settokens":
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(args), &fields); err != nil {
+			return "[redacted]"
+		}
+		for name := range fields {
+			if strings.Contains(strings.ToLower(name), "token") {
+				fields[name] = "[redacted]"
+			}
+		}
+		redacted, _ := json.Marshal(fields)
+		return string(redacted)
+	default:
+		return args
+	}
+}
+
+// commandResult classifies the reply sent for a command by its leading
+// emoji, the way every reply of handleTelegramCommand is written.
+func commandResult(reply string) string {
+	switch {
+	case strings.HasPrefix(reply, "🚫"), strings.HasPrefix(reply, "🔑"):
+		return "rejected"
+	case strings.HasPrefix(reply, "❌"):
+		return "error"
+	case strings.HasPrefix(reply, "❓"):
+		return "unknown"
+	default:
+		return "ok"
+	}
+}
+
+// recordCommandAudit appends the audit entry of a handled command. The reply
+// is only kept for failed commands, since successful replies may contain
+// credentials (e.g. /gettokens).
+func recordCommandAudit(message *tgbotapi.Message, reply string) {
+	command := message.Command()
+	result := commandResult(reply)
+	if result == "ok" && isReadOnlyCommand(command) {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:     time.Now().UTC(),
+		UserID:   message.From.ID,
+		Username: message.From.UserName,
+		Command:  command,
+		Args:     redactCommandArgs(command, message.CommandArguments()),
+		Result:   result,
+	}
+	if result != "ok" {
+		entry.Detail = reply
+		if firstLine, _, found := strings.Cut(entry.Detail, "\n"); found {
+			entry.Detail = firstLine
+		}
+		if detail := []rune(entry.Detail); len(detail) > auditDetailLength {
+			entry.Detail = string(detail[:auditDetailLength]) + "…"
+		}
+	}
+
+	if err := appendAuditEntry(entry); err != nil {
+		logError(entry.UserID, entry.Username, "Error writing audit entry", err)
+	}
+}
+
+func appendAuditEntry(entry AuditEntry) error {
+	jsonEntry, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(auditKey(entry.Time), string(jsonEntry), nil)
+		return err
+	})
+}
+
+// AuditFilter selects audit entries. Zero fields match everything; To is
+// exclusive.
+type AuditFilter struct {
+	UserID  int64
+	Command string
+	From    time.Time
+	To      time.Time
+}
+
+func (filter AuditFilter) matches(entry AuditEntry) bool {
+	return (filter.UserID == 0 || entry.UserID == filter.UserID) &&
+		(filter.Command == "" || entry.Command == filter.Command)
+}
+
+// queryAuditEntries returns the entries matching filter, oldest first.
+func queryAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	from := "audit:"
+	if !filter.From.IsZero() {
+		from = auditKeyBound(filter.From)
+	}
+	to := "audit;" // ';' sorts right after ':'
+	if !filter.To.IsZero() {
+		to = auditKeyBound(filter.To)
+	}
+
+	var entries []AuditEntry
+	err := db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendRange("", from, to, func(key, value string) bool {
+			var entry AuditEntry
+			if json.Unmarshal([]byte(value), &entry) == nil && filter.matches(entry) {
+				entries = append(entries, entry)
+			}
+			return true
+		})
+	})
+	return entries, err
+}
+
+// parseAuditFlags reads the /audit options: --user=<id>, --command=<name>,
+// --from=<YYYY-MM-DD> and --to=<YYYY-MM-DD> (both inclusive, UTC) and
+// --limit=<n>.
+func parseAuditFlags(flags map[string]string) (AuditFilter, int, error) {
+	var filter AuditFilter
+	limit := auditDefaultLimit
+	if value, ok := flags["user"]; ok {
+		userID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return filter, 0, fmt.Errorf("user must be a numeric user ID")
+		}
+		filter.UserID = userID
+	}
+	if value, ok := flags["command"]; ok {
+		filter.Command = strings.TrimPrefix(strings.ToLower(value), "/")
+	}
+	if value, ok := flags["from"]; ok {
+		from, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return filter, 0, fmt.Errorf("from must be a date such as 2024-01-31")
+		}
+		filter.From = from
+	}
+	if value, ok := flags["to"]; ok {
+		to, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return filter, 0, fmt.Errorf("to must be a date such as 2024-01-31")
+		}
+		filter.To = to.AddDate(0, 0, 1)
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return filter, 0, fmt.Errorf("from must not be after to")
+	}
+	if value, ok := flags["limit"]; ok {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > auditMaxLimit {
+			return filter, 0, fmt.Errorf("limit must be between 1 and %d", auditMaxLimit)
+		}
+	}
+	return filter, limit, nil
+}
+
+// formatAuditEntries lists the newest limit entries, newest first.
+func formatAuditEntries(entries []AuditEntry, limit int) string {
+	var text strings.Builder
+	text.WriteString(fmt.Sprintf("📜 Audit log (%d matching entries", len(entries)))
+	if len(entries) > limit {
+		text.WriteString(fmt.Sprintf(", newest %d shown", limit))
+	}
+	text.WriteString("):\n\n")
+	for i := len(entries) - 1; i >= 0 && i >= len(entries)-limit; i-- {
+		entry := entries[i]
+		text.WriteString(fmt.Sprintf("%s %d @%s /%s", entry.Time.Format("2006-01-02 15:04:05"), entry.UserID, entry.Username, entry.Command))
+		if entry.Args != "" {
+			text.WriteString(" " + entry.Args)
+		}
+		text.WriteString(" → " + entry.Result)
+		if entry.Detail != "" {
+			text.WriteString(": " + entry.Detail)
+		}
+		text.WriteString("\n")
+	}
+	return text.String()
+}
+
+// exportAuditEntries encodes entries as JSON lines.
+func exportAuditEntries(entries []AuditEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/tidwall/buntdb"
@@ -18,13 +20,30 @@ type UserTokens struct {
 	CloudflareToken  string `json:"cloudflare_token"`
 	CloudflareZoneID string `json:"cloudflare_zone_id"`
 	VercelProjectID  string `json:"vercel_project_id"`
+	RedirectProvider string `json:"redirect_provider,omitempty"`
+	HostingProvider  string `json:"hosting_provider,omitempty"`
+	NetlifyToken     string `json:"netlify_token,omitempty"`
+	NetlifySiteID    string `json:"netlify_site_id,omitempty"`
+}
+
+func (tokens UserTokens) HostingProviderName() string {
+	if tokens.HostingProvider == "" {
+		return defaultHostingProvider
+	}
+	return tokens.HostingProvider
+}
+
+func (tokens UserTokens) RedirectProviderName() string {
+	if tokens.RedirectProvider == "" {
+		return defaultRedirectProvider
+	}
+	return tokens.RedirectProvider
 }
 
 var (
-	db                   *buntdb.DB
-	userAutoRedirectLock sync.Mutex
-	userAutoRedirectMap  map[int64]chan bool
-	secretCode           string
+	db               *buntdb.DB
+	autoRedirectLock sync.Mutex
+	autoRedirectJobs map[string]*autoRedirectHandle
 )
 
 func init() {
@@ -33,53 +52,86 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
-	userAutoRedirectMap = make(map[int64]chan bool)
+	autoRedirectJobs = make(map[string]*autoRedirectHandle)
 
 }
 
+// getUserTokens returns the tokens of the user's active profile.
 func getUserTokens(userID int64) (UserTokens, error) {
-	var tokens UserTokens
-	err := db.View(func(tx *buntdb.Tx) error {
-		val, err := tx.Get(fmt.Sprintf("user:%d", userID))
-		if err != nil {
-			return err
-		}
-		return json.Unmarshal([]byte(val), &tokens)
-	})
-	return tokens, err
+	return getProfileTokens(userID, getActiveProfileName(userID))
 }
 
+// setUserTokens stores tokens in the user's active profile.
 func setUserTokens(userID int64, tokens UserTokens) error {
-	jsonTokens, err := json.Marshal(tokens)
-	if err != nil {
-		return err
-	}
-	return db.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(fmt.Sprintf("user:%d", userID), string(jsonTokens), nil)
-		return err
-	})
+	return setProfileTokens(userID, getActiveProfileName(userID), tokens)
 }
+
 func checkAllTokensPresent(tokens UserTokens) bool {
-	return tokens.VercelToken != "" && tokens.CloudflareToken != "" && tokens.CloudflareZoneID != "" && tokens.VercelProjectID != ""
+	switch tokens.HostingProviderName() {
+	case "vercel":
+		if tokens.VercelToken == "" || tokens.VercelProjectID == "" {
+			return false
+		}
+	case "netlify":
+		if tokens.NetlifyToken == "" || tokens.NetlifySiteID == "" {
+			return false
+		}
+	}
+	if tokens.RedirectProviderName() == "cloudflare" {
+		return tokens.CloudflareToken != "" && tokens.CloudflareZoneID != ""
+	}
+	return true
 }
 
-func handleTelegramCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+// handleTelegramCommand handles a command message. API requests made for it
+// use ctx with commandRetryPolicy.
+func handleTelegramCommand(ctx context.Context, bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+	ctx = withRetryPolicy(ctx, commandRetryPolicy)
 	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
 	userID := update.Message.From.ID
 	username := update.Message.From.UserName
 
 	logInfo(userID, username, fmt.Sprintf("Received command: %s", update.Message.Command()))
+	defer func() { recordCommandAudit(update.Message, msg.Text) }()
 
+	// Tokens should not stay in the chat history, whether or not the command
+	// is allowed or succeeds.
+	if isSecretCommand(update.Message.Command()) && update.Message.CommandArguments() != "" {
+		defer deleteSecretMessage(bot, update.Message)
+	}
 
-	tokens, _ := getUserTokens(int64(userID))
+	profile := getActiveProfileName(int64(userID))
+	tokens, _ := getProfileTokens(int64(userID), profile)
 
-	if !isWhitelisted(int64(userID)) && !isAdminCommand(update.Message.Command()) {
-		msg.Text = "🚫 You are not authorized to use this bot. Please contact an admin for access."
+	role := getUserRole(int64(userID))
+	if required := requiredRole(update.Message.Command()); role < required {
+		if role == roleNone {
+			msg.Text = fmt.Sprintf("🚫 You are not authorized to use this bot. Please send your user ID (%d) to an admin for access.", userID)
+		} else {
+			msg.Text = fmt.Sprintf("🚫 This command needs the %s role, your role is %s.", required, role)
+		}
 		bot.Send(msg)
 		return
 	}
 
-	if !checkAllTokensPresent(tokens) && !isTokenSetupCommand(update.Message.Command()) {
+	// Team profiles additionally need the matching role in the team.
+	if team, _ := splitProfileRef(profile); team != "" && usesActiveProfile(update.Message.Command()) {
+		if teamRole := teamRole(team, int64(userID)); teamRole == roleNone {
+			msg.Text = fmt.Sprintf("🚫 You are not a member of team %s, which owns your active profile %s. Use /profile use <name> to switch profiles.", team, profile)
+			bot.Send(msg)
+			return
+		} else if required := requiredRole(update.Message.Command()); teamRole < required {
+			msg.Text = fmt.Sprintf("🚫 This command needs the %s role in team %s, your team role is %s.", required, team, teamRole)
+			bot.Send(msg)
+			return
+		}
+	}
+
+	// Users who can only view the active profile cannot set its tokens, so
+	// read-only commands run with whatever the profile has.
+	canEditProfile := role >= roleOperator && profileRole(int64(userID), profile) >= roleOperator
+	readOnly := requiredRole(update.Message.Command()) <= roleViewer
+	if !checkAllTokensPresent(tokens) && !isTokenSetupCommand(update.Message.Command()) && (canEditProfile || !readOnly) {
 		msg.Text = "🔑 Please ensure all your API tokens are set using the appropriate commands. Use /help to set the tokens."
 		bot.Send(msg)
 		return
@@ -96,11 +148,12 @@ func handleTelegramCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 			return
 		}
 		tokens.VercelToken = token
-		err := setUserTokens(int64(userID), tokens)
-		if err != nil {
+		if notes, err := checkCredentials(ctx, tokens, "vercel"); err != nil {
+			msg.Text = "🚫 Vercel token not saved: " + err.Error()
+		} else if err := setUserTokens(int64(userID), tokens); err != nil {
 			msg.Text = "❌ Error saving Vercel token: " + err.Error()
 		} else {
-			msg.Text = "✅ Vercel token saved successfully!"
+			msg.Text = formatSavedMessage("Vercel token", notes)
 		}
 
 	case "setcloudflaretoken":
@@ -111,11 +164,12 @@ func handleTelegramCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 			return
 		}
 		tokens.CloudflareToken = token
-		err := setUserTokens(int64(userID), tokens)
-		if err != nil {
+		if notes, err := checkCredentials(ctx, tokens, "cloudflare"); err != nil {
+			msg.Text = "🚫 Cloudflare token not saved: " + err.Error()
+		} else if err := setUserTokens(int64(userID), tokens); err != nil {
 			msg.Text = "❌ Error saving Cloudflare token: " + err.Error()
 		} else {
-			msg.Text = "✅ Cloudflare token saved successfully!"
+			msg.Text = formatSavedMessage("Cloudflare token", notes)
 		}
 
 	case "setcloudflarezoneid":
@@ -126,11 +180,12 @@ func handleTelegramCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 			return
 		}
 		tokens.CloudflareZoneID = zoneID
-		err := setUserTokens(int64(userID), tokens)
-		if err != nil {
+		if notes, err := checkCredentials(ctx, tokens, "cloudflare"); err != nil {
+			msg.Text = "🚫 Cloudflare Zone ID not saved: " + err.Error()
+		} else if err := setUserTokens(int64(userID), tokens); err != nil {
 			msg.Text = "❌ Error saving Cloudflare Zone ID: " + err.Error()
 		} else {
-			msg.Text = "✅ Cloudflare Zone ID saved successfully!"
+			msg.Text = formatSavedMessage("Cloudflare Zone ID", notes)
 		}
 
 	case "setvercelprojectid":
@@ -141,17 +196,257 @@ func handleTelegramCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 			return
 		}
 		tokens.VercelProjectID = projectID
-		err := setUserTokens(int64(userID), tokens)
-		if err != nil {
+		if notes, err := checkCredentials(ctx, tokens, "vercel"); err != nil {
+			msg.Text = "🚫 Vercel Project ID not saved: " + err.Error()
+		} else if err := setUserTokens(int64(userID), tokens); err != nil {
 			msg.Text = "❌ Error saving Vercel Project ID: " + err.Error()
 		} else {
-			msg.Text = "✅ Vercel Project ID saved successfully!"
+			msg.Text = formatSavedMessage("Vercel Project ID", notes)
+		}
+
+	case "setnetlifytoken":
+		token := update.Message.CommandArguments()
+		if token == "" {
+			msg.Text = "🚫 Netlify token cannot be empty. Please provide a valid token."
+			bot.Send(msg)
+			return
+		}
+		tokens.NetlifyToken = token
+		if notes, err := checkCredentials(ctx, tokens, "netlify"); err != nil {
+			msg.Text = "🚫 Netlify token not saved: " + err.Error()
+		} else if err := setUserTokens(int64(userID), tokens); err != nil {
+			msg.Text = "❌ Error saving Netlify token: " + err.Error()
+		} else {
+			msg.Text = formatSavedMessage("Netlify token", notes)
+		}
+
+	case "setnetlifysiteid":
+		siteID := update.Message.CommandArguments()
+		if siteID == "" {
+			msg.Text = "🚫 Netlify Site ID cannot be empty. Please provide a valid Site ID."
+			bot.Send(msg)
+			return
+		}
+		tokens.NetlifySiteID = siteID
+		if notes, err := checkCredentials(ctx, tokens, "netlify"); err != nil {
+			msg.Text = "🚫 Netlify Site ID not saved: " + err.Error()
+		} else if err := setUserTokens(int64(userID), tokens); err != nil {
+			msg.Text = "❌ Error saving Netlify Site ID: " + err.Error()
+		} else {
+			msg.Text = formatSavedMessage("Netlify Site ID", notes)
+		}
+
+	case "sethostingprovider":
+		name := strings.ToLower(strings.TrimSpace(update.Message.CommandArguments()))
+		if !isValidHostingProviderName(name) {
+			msg.Text = "🚫 Please provide a hosting provider. Usage: /sethostingprovider vercel|netlify"
+			break
+		}
+		tokens.HostingProvider = name
+		if err := setUserTokens(int64(userID), tokens); err != nil {
+			msg.Text = "❌ Error saving hosting provider: " + err.Error()
+		} else {
+			msg.Text = fmt.Sprintf("✅ Profile %s now uses the %s hosting provider.", profile, name)
+		}
+
+	case "profile":
+		args := strings.Fields(update.Message.CommandArguments())
+		if len(args) == 0 {
+			msg.Text = fmt.Sprintf("👤 Active profile: %s\nUsage: /profile add|use|delete <name> or /profile list", profile)
+			break
+		}
+		switch args[0] {
+		case "list":
+			names, err := listProfiles(int64(userID))
+			if err == nil {
+				var teams []*Team
+				teams, err = getUserTeams(int64(userID))
+				for _, team := range teams {
+					if err != nil {
+						break
+					}
+					var teamNames []string
+					teamNames, err = listTeamProfiles(team.Name)
+					names = append(names, teamNames...)
+				}
+			}
+			if err != nil {
+				msg.Text = "❌ Error listing profiles: " + err.Error()
+			} else if len(names) == 0 {
+				msg.Text = "📃 You have no profiles yet. Set your tokens or use /profile add <name>."
+			} else {
+				var profileList strings.Builder
+				profileList.WriteString("📃 Your profiles:\n\n")
+				for _, name := range names {
+					marker := "-"
+					if name == profile {
+						marker = "👉"
+					}
+					profileList.WriteString(fmt.Sprintf("%s %s\n", marker, name))
+				}
+				msg.Text = profileList.String()
+			}
+		case "add", "use", "delete":
+			if len(args) != 2 || !isValidProfileRef(args[1]) {
+				msg.Text = fmt.Sprintf("🚫 Please provide a profile name made of lowercase letters, digits, '-' or '_', or <team>/<name> for a team profile. Usage: /profile %s <name>", args[0])
+				break
+			}
+			name := args[1]
+			if args[0] != "use" && role < roleOperator {
+				msg.Text = fmt.Sprintf("🚫 /profile %s needs the operator role, your role is %s.", args[0], role)
+				break
+			}
+			// Any team member may select a team profile, only team admins
+			// may create or delete one.
+			required := roleAdmin
+			if args[0] == "use" {
+				required = roleViewer
+			}
+			if team, _ := splitProfileRef(name); team != "" && profileRole(int64(userID), name) < required {
+				msg.Text = fmt.Sprintf("🚫 This needs the %s role in team %s.", required, team)
+				break
+			}
+			var err error
+			switch args[0] {
+			case "add":
+				if err = addProfile(int64(userID), name); err == nil {
+					err = setActiveProfile(int64(userID), name)
+				}
+				msg.Text = fmt.Sprintf("✅ Profile %s created and selected. Set its tokens with the token commands.", name)
+			case "use":
+				err = setActiveProfile(int64(userID), name)
+				msg.Text = fmt.Sprintf("✅ Now using profile %s.", name)
+			case "delete":
+				if name == profile {
+					msg.Text = "🚫 You cannot delete the active profile. Switch to another profile first."
+					break
+				}
+				err = deleteProfile(int64(userID), name)
+				msg.Text = fmt.Sprintf("✅ Profile %s deleted.", name)
+			}
+			if err != nil {
+				msg.Text = "❌ Error managing profile: " + err.Error()
+			}
+		default:
+			msg.Text = "🚫 Unknown profile action. Usage: /profile add|use|delete <name> or /profile list"
+		}
+
+	case "team":
+		args := strings.Fields(update.Message.CommandArguments())
+		usage := "Usage: /team create|delete|members <team>, /team add <team> <user_id> [admin|operator|viewer], /team remove <team> <user_id> or /team list"
+		if len(args) == 0 {
+			msg.Text = "👥 " + usage
+			break
+		}
+		if args[0] == "list" {
+			teams, err := getUserTeams(int64(userID))
+			if err != nil {
+				msg.Text = "❌ Error listing teams: " + err.Error()
+			} else if len(teams) == 0 {
+				msg.Text = "📃 You are not a member of any team. Use /team create <name> to create one."
+			} else {
+				var teamList strings.Builder
+				teamList.WriteString("📃 Your teams:\n\n")
+				for _, team := range teams {
+					teamList.WriteString(fmt.Sprintf("- %s (%s, %d members)\n", team.Name, team.role(int64(userID)), len(team.Members)))
+				}
+				msg.Text = teamList.String()
+			}
+			break
+		}
+		if len(args) < 2 || !isValidProfileName(args[1]) {
+			msg.Text = "🚫 Please provide a team name made of lowercase letters, digits, '-' or '_'. " + usage
+			break
+		}
+		teamName := args[1]
+		if args[0] == "create" {
+			if err := createTeam(teamName, int64(userID)); err != nil {
+				msg.Text = "❌ Error creating team: " + err.Error()
+			} else {
+				msg.Text = fmt.Sprintf("✅ Team %s created, you are its admin. Add members with /team add %s <user_id> and shared profiles with /profile add %s/<name>.", teamName, teamName, teamName)
+			}
+			break
+		}
+
+		myTeamRole := teamRole(teamName, int64(userID))
+		if myTeamRole == roleNone {
+			msg.Text = fmt.Sprintf("🚫 You are not a member of team %s.", teamName)
+			break
+		}
+		switch args[0] {
+		case "members":
+			team, err := getTeam(teamName)
+			if err != nil {
+				msg.Text = "❌ Error loading team: " + err.Error()
+			} else {
+				msg.Text = formatTeamMembers(team)
+			}
+		case "add", "remove":
+			if myTeamRole < roleAdmin {
+				msg.Text = fmt.Sprintf("🚫 Only admins of team %s can manage its members.", teamName)
+				break
+			}
+			if len(args) < 3 {
+				msg.Text = "🚫 Please provide a user ID. " + usage
+				break
+			}
+			memberID, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil {
+				msg.Text = "🚫 Invalid user ID. Please provide a valid numeric ID."
+				break
+			}
+			if args[0] == "remove" {
+				if err := removeTeamMember(teamName, memberID); err != nil {
+					msg.Text = "❌ Error removing member: " + err.Error()
+				} else {
+					msg.Text = fmt.Sprintf("✅ User %d removed from team %s.", memberID, teamName)
+				}
+				break
+			}
+			memberRole := roleOperator
+			if len(args) > 3 {
+				var ok bool
+				if memberRole, ok = parseRole(args[3]); !ok || !isValidTeamRole(memberRole) {
+					msg.Text = "🚫 Invalid team role. Use admin, operator or viewer."
+					break
+				}
+			}
+			if err := setTeamMember(teamName, memberID, memberRole); err != nil {
+				msg.Text = "❌ Error adding member: " + err.Error()
+			} else {
+				msg.Text = fmt.Sprintf("✅ User %d is now %s in team %s.", memberID, memberRole, teamName)
+			}
+		case "delete":
+			if myTeamRole < roleAdmin {
+				msg.Text = fmt.Sprintf("🚫 Only admins of team %s can delete it.", teamName)
+			} else if err := deleteTeam(teamName); err != nil {
+				msg.Text = "❌ Error deleting team: " + err.Error()
+			} else {
+				msg.Text = fmt.Sprintf("✅ Team %s and its profiles deleted.", teamName)
+			}
+		default:
+			msg.Text = "🚫 Unknown team action. " + usage
+		}
+
+	case "setredirectprovider":
+		name := strings.ToLower(strings.TrimSpace(update.Message.CommandArguments()))
+		if !isValidRedirectProviderName(name) {
+			msg.Text = "🚫 Please provide a redirect provider. Usage: /setredirectprovider cloudflare|caddy"
+			break
+		}
+		tokens.RedirectProvider = name
+		if _, err := newRedirectProvider(ctx, int64(userID), profile, tokens); err != nil {
+			msg.Text = "❌ Error selecting redirect provider: " + err.Error()
+		} else if err := setUserTokens(int64(userID), tokens); err != nil {
+			msg.Text = "❌ Error saving redirect provider: " + err.Error()
+		} else {
+			msg.Text = fmt.Sprintf("✅ Profile %s now uses the %s redirect provider.", profile, name)
 		}
 
 	case "gettokens":
 		msg.Text = fmt.Sprintf(
-			"🔑 Your tokens:\nVercel Token: %s\nCloudflare Token: %s\nCloudflare Zone ID: %s\nVercel Project ID: %s",
-			tokens.VercelToken, tokens.CloudflareToken, tokens.CloudflareZoneID, tokens.VercelProjectID,
+			"🔑 Your tokens (profile %s):\nVercel Token: %s\nCloudflare Token: %s\nCloudflare Zone ID: %s\nVercel Project ID: %s\nNetlify Token: %s\nNetlify Site ID: %s\nHosting Provider: %s\nRedirect Provider: %s",
+			profile, maskSecret(tokens.VercelToken), maskSecret(tokens.CloudflareToken), tokens.CloudflareZoneID, tokens.VercelProjectID, maskSecret(tokens.NetlifyToken), tokens.NetlifySiteID, tokens.HostingProviderName(), tokens.RedirectProviderName(),
 		)
 	case "settokens":
 		args := update.Message.CommandArguments()
@@ -159,17 +454,20 @@ func handleTelegramCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 		err := json.Unmarshal([]byte(args), &newTokens)
 		if err != nil {
 			msg.Text = "🚫 Invalid JSON format. Please provide tokens in the format: {\"vercel_token\":\"...\",\"cloudflare_token\":\"...\",\"cloudflare_zone_id\":\"...\",\"vercel_project_id\":\"...\"}"
+		} else if notes, err := checkCredentials(ctx, newTokens, "vercel", "cloudflare", "netlify"); err != nil {
+			msg.Text = "🚫 Tokens not saved: " + err.Error()
+		} else if err := setUserTokens(int64(userID), newTokens); err != nil {
+			msg.Text = "❌ Error saving tokens: " + err.Error()
 		} else {
-			err = setUserTokens(int64(userID), newTokens)
-			if err != nil {
-				msg.Text = "❌ Error saving tokens: " + err.Error()
-			} else {
-				msg.Text = "✅ Tokens saved successfully!"
-			}
+			msg.Text = formatSavedMessage("Tokens", notes)
 		}
 
 	case "getdomains":
-		domains, err := getVercelDomains(tokens.VercelProjectID, tokens.VercelToken)
+		var domains []string
+		hosting, err := newHostingProvider(ctx, tokens)
+		if err == nil {
+			domains, err = hosting.ListDomains()
+		}
 		if err != nil {
 			msg.Text = "❌ Error getting domains: " + err.Error()
 		} else {
@@ -181,7 +479,10 @@ func handleTelegramCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 		if args == "" {
 			msg.Text = "🚫 Please provide a domain name. Usage: /setdomain your-domain.vercel.app"
 		} else {
-			err := addVercelDomain(tokens.VercelProjectID, args, tokens.VercelToken)
+			hosting, err := newHostingProvider(ctx, tokens)
+			if err == nil {
+				err = hosting.AddDomain(args)
+			}
 			if err != nil {
 				msg.Text = "❌ Error adding domain: " + err.Error()
 			} else {
@@ -194,7 +495,10 @@ func handleTelegramCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 		if args == "" {
 			msg.Text = "🚫 Please provide a domain name. Usage: /deletedomain your-domain.vercel.app"
 		} else {
-			err := deleteVercelDomain(tokens.VercelProjectID, args, tokens.VercelToken)
+			hosting, err := newHostingProvider(ctx, tokens)
+			if err == nil {
+				err = hosting.RemoveDomain(args)
+			}
 			if err != nil {
 				msg.Text = "❌ Error deleting domain: " + err.Error()
 			} else {
@@ -203,120 +507,268 @@ func handleTelegramCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 		}
 
 	case "getredirects":
-		rules, err := getCloudflareRedirectRules(tokens.CloudflareZoneID, tokens.CloudflareToken)
+		var rules []RedirectRule
+		provider, err := newRedirectProvider(ctx, int64(userID), profile, tokens)
+		if err == nil {
+			rules, err = provider.ListRules()
+		}
 		if err != nil {
 			msg.Text = "❌ Error fetching redirect rules: " + err.Error()
 		} else {
 			var rulesText strings.Builder
-			rulesText.WriteString("🔄 Current redirect rules:\n\n")
-			for _, rule := range rules {
+			rulesText.WriteString(fmt.Sprintf("🔄 Current redirect rules (%s):\n\n", provider.Name()))
+			for i, rule := range rules {
+				rulesText.WriteString(fmt.Sprintf("#%d (ID: %s)\n", i+1, rule.ID))
 				rulesText.WriteString(fmt.Sprintf("📝 Description: %s\n", rule.Description))
 				rulesText.WriteString(fmt.Sprintf("🔍 Expression: %s\n", rule.Expression))
 				rulesText.WriteString(fmt.Sprintf("🌐 Target URL: %s\n", rule.ActionParameters.FromValue.TargetURL.Value))
 				rulesText.WriteString(fmt.Sprintf("🔢 Status Code: %d\n", rule.ActionParameters.FromValue.StatusCode))
+				rulesText.WriteString(fmt.Sprintf("❓ Query String: %s\n", formatQueryStringHandling(rule.ActionParameters.FromValue.PreserveQueryString)))
+				if !rule.Enabled {
+					rulesText.WriteString("⏸️ Disabled\n")
+				}
+				if isBotRedirectRule(rule) {
+					rulesText.WriteString("🤖 Managed by this bot\n")
+				}
 				rulesText.WriteString("\n")
 			}
 			msg.Text = rulesText.String()
 		}
 
 	case "setredirect":
-		targetURL := update.Message.CommandArguments()
-		if targetURL == "" {
-			msg.Text = "🚫 Please provide a target URL. Usage: /setredirect https://target-domain.com"
+		args, flags := parseCommandArgs(update.Message.CommandArguments())
+		if len(args) == 0 || len(args) > 2 {
+			msg.Text = "🚫 Please provide a target URL. Usage: /setredirect [source-host[/path]] https://target-domain.com [--status=301|302|307|308] [--query=keep|drop]"
 		} else {
+			var config RedirectConfig
+			if err := applyRedirectFlags(flags, &config); err != nil {
+				msg.Text = "🚫 Invalid option: " + err.Error()
+				break
+			}
+			if len(args) == 2 {
+				if err := parseRedirectSource(args[0], &config); err != nil {
+					msg.Text = "🚫 Invalid source: " + err.Error()
+					break
+				}
+			}
+			targetURL := args[len(args)-1]
 			if !strings.HasPrefix(targetURL, "http://") && !strings.HasPrefix(targetURL, "https://") {
 				targetURL = "https://" + targetURL
 			}
 
+			config.TargetURL = targetURL
+			if err := validateRedirectTarget(config); err != nil {
+				msg.Text = "🚫 Invalid URL: " + err.Error()
+				break
+			}
+
 			parsedURL, err := url.Parse(targetURL)
 			if err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" || !strings.Contains(parsedURL.Host, ".") {
 				msg.Text = "🚫 Invalid URL. Please provide a valid target URL."
 				return
 			}
+			// The rule gets the URL as parsed, not the raw argument.
+			config.TargetURL = parsedURL.String()
 
-			vercelDomains, err := getVercelDomains(tokens.VercelProjectID, tokens.VercelToken)
+			var hostedDomains []string
+			hosting, err := newHostingProvider(ctx, tokens)
+			if err == nil {
+				hostedDomains, err = hosting.ListDomains()
+			}
 			if err != nil {
-				msg.Text = "❌ Error getting Vercel domains: " + err.Error()
+				msg.Text = "❌ Error getting hosted domains: " + err.Error()
 			} else {
 				found := false
-				for _, domain := range vercelDomains {
+				for _, domain := range hostedDomains {
 					if domain == parsedURL.Host {
 						found = true
 						break
 					}
 				}
 				if !found {
-					warningMsg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("⚠️ Warning: The domain %s is not found in Vercel domains.", parsedURL.Host))
+					warningMsg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("⚠️ Warning: The domain %s is not found in your %s domains.", parsedURL.Host, hosting.Name()))
 					bot.Send(warningMsg)
 				}
 			}
 
-			err = setRedirect(targetURL, tokens.CloudflareZoneID, tokens.CloudflareToken)
+			provider, err := newRedirectProvider(ctx, int64(userID), profile, tokens)
+			if err == nil {
+				err = provider.SetRedirect(config)
+			}
 			if err != nil {
 				msg.Text = "❌ Error setting redirect: " + err.Error()
 			} else {
-				msg.Text = fmt.Sprintf("✅ Redirect rule set successfully. Target URL: %s", targetURL)
+				msg.Text = fmt.Sprintf("✅ Redirect rule set successfully. Source: %s. Target URL: %s (status %d, query string %s)", config.Source(), config.TargetURL, config.EffectiveStatusCode(), formatQueryStringHandling(!config.DropQueryString))
 			}
 		}
 
+	case "deleteredirect", "disableredirect", "enableredirect":
+		selector := strings.TrimSpace(update.Message.CommandArguments())
+		if selector == "" {
+			msg.Text = fmt.Sprintf("🚫 Please provide a rule number or ID from /getredirects. Usage: /%s <number|rule-id>", update.Message.Command())
+			break
+		}
+		provider, err := newRedirectProvider(ctx, int64(userID), profile, tokens)
+		if err != nil {
+			msg.Text = "❌ Error updating redirect rule: " + err.Error()
+			break
+		}
+		var rule RedirectRule
+		var action string
+		switch update.Message.Command() {
+		case "deleteredirect":
+			rule, err = provider.DeleteRule(selector)
+			action = "deleted"
+		case "disableredirect":
+			rule, err = provider.SetRuleEnabled(selector, false)
+			action = "disabled"
+		case "enableredirect":
+			rule, err = provider.SetRuleEnabled(selector, true)
+			action = "enabled"
+		}
+		if err != nil {
+			msg.Text = "❌ Error updating redirect rule: " + err.Error()
+		} else {
+			msg.Text = fmt.Sprintf("✅ Redirect rule %s %s: %s", rule.ID, action, rule.Description)
+		}
+
 	case "startautoredirect":
-		userAutoRedirectLock.Lock()
-		defer userAutoRedirectLock.Unlock()
+		args, flags := parseCommandArgs(update.Message.CommandArguments())
+		job := &AutoRedirectJob{
+			UserID:   int64(userID),
+			ChatID:   update.Message.Chat.ID,
+			Username: username,
+			Profile:  profile,
+		}
+		if err := applyPoolFlags(flags, job); err != nil {
+			msg.Text = "🚫 Invalid option: " + err.Error()
+			break
+		}
+		// Pool jobs do not generate domains, so they take no seed text.
+		if len(job.Pool) == 0 && len(args) > 0 {
+			job.SeedText, args = strings.ToLower(args[0]), args[1:]
+		}
 
-		if _, exists := userAutoRedirectMap[int64(userID)]; exists {
-			msg.Text = "⏳ Auto-redirect is already running. Use /stopautoredirect to stop it first."
+		if len(args) < 1 {
+			msg.Text = "🚫 Please provide a seed text (project name) and a schedule, or a schedule and --pool. Usage: /startautoredirect your-seed-text schedule [--name=number|words|date|hex] [--name-length=6] [--name-words=a,b,c] [--status=301|302|307|308] [--query=keep|drop] [--probe=on|off] [--probe-path=/] [--probe-status=200] [--probe-body=text] [--probe-timeout=10s] [--probe-retries=2]\nor: /startautoredirect schedule --pool=a.example.com,b.example.com [--pool-order=roundrobin|random] [options]\nThe schedule is a refresh time in minutes, \"every 30m between 08:00-22:00 Europe/Berlin otherwise 1h\" or \"cron */30 * * * * Europe/Berlin\"."
+		} else if err := applyRedirectFlags(flags, &job.Redirect); err != nil {
+			msg.Text = "🚫 Invalid option: " + err.Error()
+		} else if err := applyProbeFlags(flags, &job.Probe); err != nil {
+			msg.Text = "🚫 Invalid option: " + err.Error()
+		} else if err := applyDomainTemplateFlags(flags, &job.Naming); err != nil {
+			msg.Text = "🚫 Invalid option: " + err.Error()
+		} else if len(job.Pool) == 0 && !isValidDomainSeed(job.SeedText) {
+			msg.Text = "🚫 Invalid seed text. Use up to 40 letters, digits and dashes, not starting or ending with a dash."
 		} else {
-			args := strings.Fields(update.Message.CommandArguments())
-			if len(args) < 2 {
-				msg.Text = "🚫 Please provide a seed text (project name) and refresh time in minutes. Usage: /startautoredirect your-seed-text refresh-time"
-			} else {
-				seedText := args[0]
-				refreshTime, err := strconv.Atoi(args[1])
-				if err != nil || refreshTime <= 0 {
-					msg.Text = "🚫 Invalid refresh time. Please provide a positive integer for the refresh time in minutes."
-				} else {
-					stopChan := make(chan bool)
-					userAutoRedirectMap[int64(userID)] = stopChan
-
-					go func() {
-						defer func() {
-							if r := recover(); r != nil {
-								errorMsg := fmt.Sprintf("🛑 Unexpected error occurred: %v", r)
-								msg := tgbotapi.NewMessage(update.Message.Chat.ID, errorMsg)
-								bot.Send(msg)
-
-								// Clean up the auto-redirect
-								userAutoRedirectLock.Lock()
-								delete(userAutoRedirectMap, int64(userID))
-								userAutoRedirectLock.Unlock()
-
-								stopMsg := tgbotapi.NewMessage(update.Message.Chat.ID, "🛑 Auto-redirect stopped due to an unexpected error. Use /stopautoredirect to clean up if needed.")
-								bot.Send(stopMsg)
-							}
-						}()
-						autoRedirectLoop(bot, update.Message.Chat.ID, int64(userID), username, seedText, tokens, refreshTime, stopChan)
-
-						// Clean up after autoRedirectLoop finishes (due to error or stop signal)
-						userAutoRedirectLock.Lock()
-						delete(userAutoRedirectMap, int64(userID))
-						userAutoRedirectLock.Unlock()
-					}()
-
-					msg.Text = fmt.Sprintf("🔄 Auto-redirect started. It will update every %d minutes.", refreshTime)
+			job.Schedule = strings.Join(args, " ")
+			schedule, err := parseSchedule(job.Schedule)
+			if err != nil {
+				msg.Text = "🚫 Invalid schedule: " + err.Error()
+				break
+			}
+			hosting, err := newHostingProvider(ctx, tokens)
+			if err != nil {
+				msg.Text = "❌ Error loading the hosting provider: " + err.Error()
+				break
+			}
+			if len(job.Pool) > 0 {
+				if err := checkPoolDomains(hosting, job.Pool); err != nil {
+					msg.Text = "🚫 Invalid domain pool: " + err.Error()
+					break
 				}
+			} else if err := checkGeneratedDomainSupport(hosting); err != nil {
+				msg.Text = "🚫 " + err.Error() + "."
+				break
+			}
+
+			autoRedirectLock.Lock()
+			err = startAutoRedirect(bot, job)
+			autoRedirectLock.Unlock()
+			if err != nil {
+				msg.Text = "❌ Error starting auto-redirect: " + err.Error()
+				break
+			}
+			domains := "🏷️ Domain names: " + job.Naming.String()
+			if len(job.Pool) > 0 {
+				domains = "🎱 Domain pool: " + job.poolDescription()
 			}
+			msg.Text = fmt.Sprintf("🔄 Auto-redirect job %s started for profile %s. It updates now and then %s using %d redirects.\n📅 Planned updates:\n%s%s\n🩺 Health check: %s\nUse /stopautoredirect %s to stop it.", job.ID, profile, schedule, job.Redirect.EffectiveStatusCode(), formatPlannedRuns(plannedRuns(schedule, time.Now(), 5)), domains, job.Probe, job.ID)
 		}
 
 	case "stopautoredirect":
-		userAutoRedirectLock.Lock()
-		if stopChan, exists := userAutoRedirectMap[int64(userID)]; exists {
-			close(stopChan)
-			delete(userAutoRedirectMap, int64(userID))
-			msg.Text = "⏹️ Auto-redirect stopped."
+		jobID, errText := resolveJobID(int64(userID), update.Message.Command(), update.Message.CommandArguments())
+		if errText != "" {
+			msg.Text = errText
+		} else if err := stopAutoRedirect(int64(userID), jobID); err != nil {
+			msg.Text = "🚫 " + err.Error() + ". Use /jobs to list your running jobs."
+		} else {
+			msg.Text = fmt.Sprintf("⏹️ Auto-redirect job %s stopped.", jobID)
+		}
+
+	case "rotatenow":
+		jobID, errText := resolveJobID(int64(userID), update.Message.Command(), update.Message.CommandArguments())
+		if errText != "" {
+			msg.Text = errText
+		} else if err := controlAutoRedirect(int64(userID), jobID, controlRotateNow); err != nil {
+			msg.Text = "🚫 " + err.Error() + ". Use /jobs to list your running jobs."
+		} else {
+			msg.Text = fmt.Sprintf("⏩ Auto-redirect job %s is rotating now. You will get the usual update message when the new domain is live.", jobID)
+		}
+
+	case "pauseautoredirect":
+		jobID, errText := resolveJobID(int64(userID), update.Message.Command(), update.Message.CommandArguments())
+		if errText != "" {
+			msg.Text = errText
+		} else if err := controlAutoRedirect(int64(userID), jobID, controlPause); err != nil {
+			msg.Text = "🚫 " + err.Error() + ". Use /jobs to list your running jobs."
+		} else {
+			msg.Text = fmt.Sprintf("⏸️ Auto-redirect job %s paused. The current domain and redirect stay in place. Use /resumeautoredirect %s to resume it.", jobID, jobID)
+		}
+
+	case "resumeautoredirect":
+		jobID, errText := resolveJobID(int64(userID), update.Message.Command(), update.Message.CommandArguments())
+		if errText != "" {
+			msg.Text = errText
+		} else if err := controlAutoRedirect(int64(userID), jobID, controlResume); err != nil {
+			msg.Text = "🚫 " + err.Error() + ". Use /jobs to list your running jobs."
 		} else {
-			msg.Text = "🚫 Auto-redirect is not running."
+			msg.Text = fmt.Sprintf("▶️ Auto-redirect job %s resumed.", jobID)
+		}
+
+	case "jobs":
+		jobs, err := getUserAutoRedirectJobs(int64(userID))
+		if err != nil {
+			msg.Text = "❌ Error loading your jobs: " + err.Error()
+		} else if len(jobs) == 0 {
+			msg.Text = "📃 You have no running auto-redirect jobs."
+		} else {
+			var jobsText strings.Builder
+			jobsText.WriteString("⏱️ Running auto-redirect jobs:\n\n")
+			for _, job := range jobs {
+				jobsText.WriteString(fmt.Sprintf("🆔 Job: %s (profile %s)\n", job.ID, job.Profile))
+				if job.UserID != int64(userID) {
+					jobsText.WriteString(fmt.Sprintf("👤 Started by: %s (%d)\n", job.Username, job.UserID))
+				}
+				if len(job.Pool) > 0 {
+					jobsText.WriteString(fmt.Sprintf("🎱 Domain pool: %s\n", job.poolDescription()))
+				} else {
+					jobsText.WriteString(fmt.Sprintf("🌱 Seed: %s (%s)\n", job.SeedText, job.Naming))
+				}
+				if schedule, err := job.schedule(); err == nil {
+					jobsText.WriteString(fmt.Sprintf("⏱️ Schedule: %s\n", schedule))
+				}
+				jobsText.WriteString(fmt.Sprintf("🔢 Status Code: %d, query string %s\n", job.Redirect.EffectiveStatusCode(), formatQueryStringHandling(!job.Redirect.DropQueryString)))
+				jobsText.WriteString(fmt.Sprintf("🩺 Health check: %s\n", job.Probe))
+				jobsText.WriteString(fmt.Sprintf("🌐 Current domain: %s\n", job.CurrentDomain))
+				if job.Paused {
+					jobsText.WriteString("⏸️ Paused\n")
+				} else {
+					jobsText.WriteString(fmt.Sprintf("⏭️ Next rotation: %s\n", formatNextRun(job.NextRun)))
+				}
+				jobsText.WriteString("\n")
+			}
+			msg.Text = jobsText.String()
 		}
-		userAutoRedirectLock.Unlock()
 
 	case "guide":
 		fmt.Println("hello")
@@ -331,67 +783,99 @@ func handleTelegramCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 		}
 		return
 
-	case "whitelistuser":
+	case "grant":
 		args := strings.Fields(update.Message.CommandArguments())
 		if len(args) != 2 {
-			msg.Text = "🚫 Invalid command. Usage: /whitelistuser <secret_code> <user_id>"
-		} else if args[0] != secretCode {
-			msg.Text = "🚫 Invalid secret code. Access denied."
+			msg.Text = "🚫 Invalid command. Usage: /grant <user_id> <owner|admin|operator|viewer>"
+			break
+		}
+		targetID, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			msg.Text = "🚫 Invalid user ID. Please provide a valid numeric ID."
+			break
+		}
+		newRole, ok := parseRole(args[1])
+		if !ok {
+			msg.Text = "🚫 Invalid role. Use owner, admin, operator or viewer."
+			break
+		}
+		if err := grantRole(int64(userID), targetID, newRole); err != nil {
+			msg.Text = "🚫 " + err.Error()
 		} else {
-			userIDToWhitelist, err := strconv.ParseInt(args[1], 10, 64)
-			if err != nil {
-				msg.Text = "🚫 Invalid user ID. Please provide a valid numeric ID."
-			} else {
-				err := whitelistUser(userIDToWhitelist)
-				if err != nil {
-					msg.Text = "❌ Error whitelisting user: " + err.Error()
-				} else {
-					msg.Text = fmt.Sprintf("✅ User %d has been whitelisted successfully!", userIDToWhitelist)
-				}
-			}
+			msg.Text = fmt.Sprintf("✅ User %d is now %s.", targetID, newRole)
 		}
 
-	case "getallwhitelistedusers":
+	case "revoke":
 		args := strings.Fields(update.Message.CommandArguments())
 		if len(args) != 1 {
-			msg.Text = "🚫 Invalid command. Usage: /getallwhitelistedusers <secret_code>"
-		} else if args[0] != secretCode {
-			msg.Text = "🚫 Invalid secret code. Access denied."
+			msg.Text = "🚫 Invalid command. Usage: /revoke <user_id>"
+			break
+		}
+		targetID, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			msg.Text = "🚫 Invalid user ID. Please provide a valid numeric ID."
+			break
+		}
+		if err := revokeRole(int64(userID), targetID); err != nil {
+			msg.Text = "🚫 " + err.Error()
 		} else {
-			whitelistedUsers, err := getAllWhitelistedUsers()
-			if err != nil {
-				msg.Text = "❌ Error retrieving whitelisted users: " + err.Error()
-			} else if len(whitelistedUsers) == 0 {
-				msg.Text = "📃 There are no whitelisted users."
-			} else {
-				var userList strings.Builder
-				userList.WriteString("📃 Whitelisted Users:\n\n")
-				for _, userID := range whitelistedUsers {
-					userList.WriteString(fmt.Sprintf("- User ID: %d\n", userID))
-				}
-				msg.Text = userList.String()
-			}
+			msg.Text = fmt.Sprintf("✅ User %d no longer has access to the bot.", targetID)
 		}
 
-	case "deletewhitelisteduser":
-		args := strings.Fields(update.Message.CommandArguments())
-		if len(args) != 2 {
-			msg.Text = "🚫 Invalid command. Usage: /deletewhitelisteduser <secret_code> <user_id>"
-		} else if args[0] != secretCode {
-			msg.Text = "🚫 Invalid secret code. Access denied."
+	case "roles":
+		userIDs, roles, err := getAllUserRoles()
+		if err != nil {
+			msg.Text = "❌ Error retrieving roles: " + err.Error()
 		} else {
-			userIDToDelete, err := strconv.ParseInt(args[1], 10, 64)
+			var roleList strings.Builder
+			roleList.WriteString("📃 Users and roles:\n\n")
+			for _, id := range userIDs {
+				roleList.WriteString(fmt.Sprintf("- User ID: %d, %s\n", id, roles[id]))
+			}
+			msg.Text = roleList.String()
+		}
+
+	case "audit":
+		_, flags := parseCommandArgs(update.Message.CommandArguments())
+		filter, limit, err := parseAuditFlags(flags)
+		if err != nil {
+			msg.Text = "🚫 Invalid option: " + err.Error() + "\nUsage: /audit [--user=<user_id>] [--command=<name>] [--from=YYYY-MM-DD] [--to=YYYY-MM-DD] [--limit=20] [--export]"
+			break
+		}
+		entries, err := queryAuditEntries(filter)
+		if err != nil {
+			msg.Text = "❌ Error reading the audit log: " + err.Error()
+			break
+		}
+		if len(entries) == 0 {
+			msg.Text = "📜 No audit entries match."
+			break
+		}
+		if _, export := flags["export"]; export {
+			data, err := exportAuditEntries(entries)
 			if err != nil {
-				msg.Text = "🚫 Invalid user ID. Please provide a valid numeric ID."
-			} else {
-				err := deleteWhitelistedUser(userIDToDelete)
-				if err != nil {
-					msg.Text = "❌ Error deleting whitelisted user: " + err.Error()
-				} else {
-					msg.Text = fmt.Sprintf("✅ User %d has been removed from the whitelist successfully!", userIDToDelete)
-				}
+				msg.Text = "❌ Error exporting the audit log: " + err.Error()
+				break
+			}
+			document := tgbotapi.NewDocument(update.Message.Chat.ID, tgbotapi.FileBytes{
+				Name:  fmt.Sprintf("audit-%s.jsonl", time.Now().UTC().Format("20060102-150405")),
+				Bytes: data,
+			})
+			document.Caption = fmt.Sprintf("📜 %d audit entries", len(entries))
+			if _, err := bot.Send(document); err != nil {
+				msg.Text = "❌ Error sending the audit export: " + err.Error()
+				break
 			}
+			return
 		}
+		if err := sendPlainLongMessage(bot, update.Message.Chat.ID, formatAuditEntries(entries, limit)); err != nil {
+			msg.Text = "❌ Error sending the audit log: " + err.Error()
+			break
+		}
+		return
+
+	case "whoami":
+		msg.Text = fmt.Sprintf("👤 Your user ID is %d and your role is %s.", userID, role)
 
 	case "help":
 		msg.Text = "📚 Help Menu: \n\n" +
@@ -402,33 +886,52 @@ func handleTelegramCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 			"/setcloudflaretoken <api-token>- Set your Cloudflare API token\n" +
 			"/setcloudflarezoneid <zone-id>- Set your Cloudflare Zone ID\n" +
 			"/setvercelprojectid <project-id>- Set your Vercel Project ID\n" +
+			"/setnetlifytoken <api-token> - Set your Netlify API token\n" +
+			"/setnetlifysiteid <site-id> - Set your Netlify Site ID\n" +
+			"/sethostingprovider <vercel|netlify> - Choose where landing domains are hosted\n" +
+			"/setredirectprovider <cloudflare|caddy> - Choose where redirect rules are managed\n" +
 			"/gettokens - Display all your API tokens\n\n" +
+			"👤 Profiles: \n" +
+			"/profile list - List your credential profiles\n" +
+			"/profile add <name> - Create a profile and switch to it\n" +
+			"/profile use <name> - Switch the active profile\n" +
+			"/profile delete <name> - Delete a profile\n" +
+			"Team profiles are named <team>/<name>, e.g. /profile use acme/shop\n\n" +
+			"👥 Teams: \n" +
+			"/team create <team> - Create a team with you as its admin\n" +
+			"/team add <team> <user-id> [admin|operator|viewer] - Add a member or change their team role\n" +
+			"/team remove <team> <user-id> - Remove a member\n" +
+			"/team members <team> - List a team's members\n" +
+			"/team list - List your teams\n" +
+			"/team delete <team> - Delete a team and its profiles\n\n" +
 			"🌐 Domain Management: \n" +
-			"/getdomains - Get the list of Vercel domains\n" +
-			"/setdomain <domain> - Add a new domain to Vercel\n" +
-			"/deletedomain <domain> - Delete a domain from Vercel\n\n" +
+			"/getdomains - Get the list of hosted domains\n" +
+			"/setdomain <domain> - Add a new domain to the hosting provider\n" +
+			"/deletedomain <domain> - Delete a domain from the hosting provider\n\n" +
 			"🔄 Redirects: \n" +
 			"/getredirects - Get the list of Cloudflare redirect rules\n" +
-			"/setredirect <url> - Set a redirect rule in Cloudflare\n\n" +
+			"/setredirect [source-host[/path]] <url> [--status=302] [--query=drop] - Set a redirect rule in Cloudflare\n" +
+			"/deleteredirect <number|id> - Delete a redirect rule\n" +
+			"/disableredirect <number|id> - Disable a redirect rule\n" +
+			"/enableredirect <number|id> - Enable a redirect rule\n\n" +
 			"⏱️ Auto-Redirect: \n" +
-			"/startautoredirect <seed-text> <refresh-time> - Start auto-redirect with seed text\n" +
-			"/stopautoredirect - Stop auto-redirect"
+			"/startautoredirect <seed-text> <schedule> [--status=302] [--query=drop] [--probe-status=200] [--probe-body=text] - Start an auto-redirect job with seed text\n" +
+			"/stopautoredirect <job-id> - Stop an auto-redirect job\n" +
+			"/rotatenow <job-id> - Rotate a job's domain right away\n" +
+			"/pauseautoredirect <job-id> - Pause a job's rotations\n" +
+			"/resumeautoredirect <job-id> - Resume a paused job\n" +
+			"/jobs - List your running auto-redirect jobs\n\n" +
+			"👤 Access: \n" +
+			"/whoami - Show your user ID and role\n" +
+			"/admin - Show the access management commands"
 
 	case "admin":
-		args := strings.Fields(update.Message.CommandArguments())
-		if len(args) < 1 {
-			msg.Text = "🚫 Invalid command. Usage: /admin <secret_code>"
-			bot.Send(msg)
-			return
-		}
-		if args[0] != secretCode {
-			msg.Text = "🚫 Invalid secret code. Access denied."
-			return
-		}
-		msg.Text = "🔐 Whitelist Management: \n\n" +
-			"/whitelistuser <secret_code> <user_id> - Add a user to the whitelist\n" +
-			"/getallwhitelistedusers <secret_code> - Get all whitelisted users\n" +
-			"/deletewhitelisteduser <secret_code> <user_id> - Remove a user from the whitelist\n"
+		msg.Text = "🔐 Access Management: \n\n" +
+			"/grant <user_id> <owner|admin|operator|viewer> - Give a user a role\n" +
+			"/revoke <user_id> - Remove a user's role and access\n" +
+			"/roles - List all users and their roles\n" +
+			"/audit [--user=<user_id>] [--command=<name>] [--from=YYYY-MM-DD] [--to=YYYY-MM-DD] [--limit=20] [--export] - Show or export the audit log\n\n" +
+			"Viewers can list domains, redirects and jobs and switch profiles, operators can use every other command, admins manage operators and viewers and owners manage everyone."
 
 	default:
 		msg.Text = "❓ Unknown command. Please use /help to get a list of available commands."
@@ -437,6 +940,16 @@ func handleTelegramCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 	bot.Send(msg)
 }
 
+// deleteSecretMessage deletes a message containing tokens, or asks the user to
+// delete it if the bot is not allowed to.
+func deleteSecretMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
+	deleteMsg := tgbotapi.NewDeleteMessage(message.Chat.ID, message.MessageID)
+	if _, err := bot.Request(deleteMsg); err != nil {
+		logError(message.From.ID, message.From.UserName, "Error deleting message containing a token", err)
+		bot.Send(tgbotapi.NewMessage(message.Chat.ID, "⚠️ I could not delete your message containing the token, please delete it yourself."))
+	}
+}
+
 func sendLongMessage(bot *tgbotapi.BotAPI, chatID int64, text string) error {
 	const maxLength = 10000
 
@@ -469,6 +982,71 @@ func sendLongMessage(bot *tgbotapi.BotAPI, chatID int64, text string) error {
 	return nil
 }
 
+// parseCommandArgs splits command arguments into positional arguments and
+// --name=value options. A bare --name option gets the value "true".
+func parseCommandArgs(arguments string) ([]string, map[string]string) {
+	var args []string
+	flags := make(map[string]string)
+	for _, field := range strings.Fields(arguments) {
+		if !strings.HasPrefix(field, "--") {
+			args = append(args, field)
+			continue
+		}
+		name, value, found := strings.Cut(strings.TrimPrefix(field, "--"), "=")
+		if !found {
+			value = "true"
+		}
+		flags[strings.ToLower(name)] = value
+	}
+	return args, flags
+}
+
+// formatSavedMessage confirms that credentials were stored, mentioning the
+// values that could not be checked yet.
+func formatSavedMessage(what string, notes []string) string {
+	if len(notes) == 0 {
+		return fmt.Sprintf("✅ %s verified and saved successfully!", what)
+	}
+	return fmt.Sprintf("✅ %s saved successfully!\n⚠️ %s", what, strings.Join(notes, "\n⚠️ "))
+}
+
+// resolveJobID returns the job ID given to a job command, or the user's only
+// job if none was given. On failure it returns the reply to send instead.
+func resolveJobID(userID int64, command, arguments string) (string, string) {
+	if jobID := strings.TrimSpace(arguments); jobID != "" {
+		return jobID, ""
+	}
+	jobs, err := getUserAutoRedirectJobs(userID)
+	if err != nil {
+		return "", "❌ Error loading your jobs: " + err.Error()
+	}
+	if len(jobs) != 1 {
+		return "", fmt.Sprintf("🚫 Please provide a job ID. Usage: /%s <job-id>\nUse /jobs to list your running jobs.", command)
+	}
+	return jobs[0].ID, ""
+}
+
+// sendPlainLongMessage sends text without Markdown parsing, split at line
+// boundaries into messages within Telegram's 4096 character limit.
+func sendPlainLongMessage(bot *tgbotapi.BotAPI, chatID int64, text string) error {
+	const maxLength = 4000
+
+	for len(text) > 0 {
+		chunk := text
+		if len(chunk) > maxLength {
+			chunk = text[:maxLength]
+			if splitIndex := strings.LastIndex(chunk, "\n"); splitIndex > 0 {
+				chunk = text[:splitIndex+1]
+			}
+		}
+		if _, err := bot.Send(tgbotapi.NewMessage(chatID, chunk)); err != nil {
+			return err
+		}
+		text = text[len(chunk):]
+	}
+	return nil
+}
+
 func readGuideFile() (string, error) {
 	content, err := ioutil.ReadFile("guide.md")
 	if err != nil {
@@ -477,21 +1055,22 @@ func readGuideFile() (string, error) {
 	return string(content), nil
 }
 
-
-func isTokenSetupCommand(command string) bool {
+// usesActiveProfile reports whether a command works on the active profile,
+// as opposed to jobs, teams, access management and help.
+func usesActiveProfile(command string) bool {
 	switch command {
-	case "setverceltoken", "setcloudflaretoken", "setcloudflarezoneid", "setvercelprojectid", "gettokens", "help", "guide", "admin","whitelistuser", "getallwhitelistedusers", "deletewhitelisteduser":
-		return true
-	default:
+	case "start", "help", "guide", "whoami", "admin", "grant", "revoke", "roles", "audit", "profile", "team", "jobs", "stopautoredirect", "rotatenow", "pauseautoredirect", "resumeautoredirect":
 		return false
+	default:
+		return true
 	}
 }
 
-func isAdminCommand(command string) bool {
+func isTokenSetupCommand(command string) bool {
 	switch command {
-	case "whitelistuser", "getallwhitelistedusers", "deletewhitelisteduser", "admin", "help","guide":
+	case "setverceltoken", "setcloudflaretoken", "setcloudflarezoneid", "setvercelprojectid", "settokens", "setnetlifytoken", "setnetlifysiteid", "sethostingprovider", "setredirectprovider", "gettokens", "profile", "team", "jobs", "stopautoredirect", "rotatenow", "pauseautoredirect", "resumeautoredirect", "help", "guide", "admin", "grant", "revoke", "roles", "audit", "whoami":
 		return true
 	default:
 		return false
 	}
-}
\ No newline at end of file
+}
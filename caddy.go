@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CaddyRedirectProvider keeps the redirect rules of a profile in a Caddyfile
+// snippet inside CADDY_CONFIG_DIR, for a local Caddy server that imports it.
+// The rules themselves live in a JSON file next to the snippet, which is
+// regenerated on every change.
+type CaddyRedirectProvider struct {
+	ConfigPath  string
+	StatePath   string
+	SiteAddress string
+}
+
+type caddyRedirectRule struct {
+	Config      RedirectConfig `json:"config"`
+	Enabled     bool           `json:"enabled"`
+	LastUpdated time.Time      `json:"last_updated"`
+}
+
+// caddyLock serializes reads and writes of the snippet files.
+var caddyLock sync.Mutex
+
+func newCaddyRedirectProvider(userID int64, profile string) (RedirectProvider, error) {
+	dir := os.Getenv("CADDY_CONFIG_DIR")
+	if dir == "" {
+		return nil, fmt.Errorf("the caddy redirect provider is not enabled on this bot (CADDY_CONFIG_DIR is not set)")
+	}
+	siteAddress := os.Getenv("CADDY_SITE_ADDRESS")
+	if siteAddress == "" {
+		siteAddress = ":80"
+	}
+	name := fmt.Sprintf("vercelredirect-%d-%s", userID, profile)
+	// Team profiles are shared, so every member must use the same files.
+	if team, profileName := splitProfileRef(profile); team != "" {
+		name = fmt.Sprintf("vercelredirect-team-%s-%s", team, profileName)
+	}
+	return &CaddyRedirectProvider{
+		ConfigPath:  filepath.Join(dir, name+".caddy"),
+		StatePath:   filepath.Join(dir, name+".json"),
+		SiteAddress: siteAddress,
+	}, nil
+}
+
+func (p *CaddyRedirectProvider) Name() string {
+	return "caddy"
+}
+
+func (p *CaddyRedirectProvider) ListRules() ([]RedirectRule, error) {
+	caddyLock.Lock()
+	defer caddyLock.Unlock()
+
+	rules, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	return toRedirectRuleset(rules).Rules, nil
+}
+
+func (p *CaddyRedirectProvider) SetRedirect(config RedirectConfig) error {
+	if err := validateRedirectScope(config); err != nil {
+		return err
+	}
+	if err := validateRedirectTarget(config); err != nil {
+		return err
+	}
+	if !isValidRedirectStatusCode(config.EffectiveStatusCode()) {
+		return fmt.Errorf("unsupported redirect status code %d", config.StatusCode)
+	}
+
+	caddyLock.Lock()
+	defer caddyLock.Unlock()
+
+	rules, err := p.load()
+	if err != nil {
+		return err
+	}
+
+	rule := caddyRedirectRule{Config: config, Enabled: true, LastUpdated: time.Now().UTC()}
+	replaced := false
+	for i, existing := range rules {
+		if existing.Config.Ref() == config.Ref() {
+			rules[i] = rule
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		rules = append(rules, rule)
+	}
+
+	return p.save(rules)
+}
+
+func (p *CaddyRedirectProvider) DeleteRule(selector string) (RedirectRule, error) {
+	caddyLock.Lock()
+	defer caddyLock.Unlock()
+
+	rules, err := p.load()
+	if err != nil {
+		return RedirectRule{}, err
+	}
+	rule, err := findRedirectRule(toRedirectRuleset(rules), selector)
+	if err != nil {
+		return RedirectRule{}, err
+	}
+
+	var remaining []caddyRedirectRule
+	for _, existing := range rules {
+		if existing.Config.Ref() != rule.ID {
+			remaining = append(remaining, existing)
+		}
+	}
+	return rule, p.save(remaining)
+}
+
+func (p *CaddyRedirectProvider) SetRuleEnabled(selector string, enabled bool) (RedirectRule, error) {
+	caddyLock.Lock()
+	defer caddyLock.Unlock()
+
+	rules, err := p.load()
+	if err != nil {
+		return RedirectRule{}, err
+	}
+	rule, err := findRedirectRule(toRedirectRuleset(rules), selector)
+	if err != nil {
+		return RedirectRule{}, err
+	}
+
+	for i := range rules {
+		if rules[i].Config.Ref() == rule.ID {
+			rules[i].Enabled = enabled
+			rules[i].LastUpdated = time.Now().UTC()
+		}
+	}
+	rule.Enabled = enabled
+	return rule, p.save(rules)
+}
+
+func (p *CaddyRedirectProvider) load() ([]caddyRedirectRule, error) {
+	data, err := os.ReadFile(p.StatePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading caddy redirect rules: %v", err)
+	}
+	var rules []caddyRedirectRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("error parsing caddy redirect rules: %v", err)
+	}
+	return rules, nil
+}
+
+func (p *CaddyRedirectProvider) save(rules []caddyRedirectRule) error {
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(p.StatePath, data); err != nil {
+		return fmt.Errorf("error writing caddy redirect rules: %v", err)
+	}
+	if err := writeFileAtomic(p.ConfigPath, []byte(p.render(rules))); err != nil {
+		return fmt.Errorf("error writing Caddyfile: %v", err)
+	}
+	return reloadCaddy()
+}
+
+// render builds the Caddyfile snippet. Caddy has no rule order of its own, so
+// redirects are placed in a route block from the most to the least specific
+// scope and the first matching one wins, as the bot also orders its rules on
+// Cloudflare. Rules saved before targets were validated are left out if they
+// are unsafe.
+func (p *CaddyRedirectProvider) render(rules []caddyRedirectRule) string {
+	var enabled []RedirectConfig
+	for _, rule := range rules {
+		if rule.Enabled && validateRedirectScope(rule.Config) == nil && validateRedirectTarget(rule.Config) == nil {
+			enabled = append(enabled, rule.Config)
+		}
+	}
+	sort.SliceStable(enabled, func(i, j int) bool {
+		return len(enabled[i].Host)+len(enabled[i].PathPrefix) > len(enabled[j].Host)+len(enabled[j].PathPrefix)
+	})
+
+	var b strings.Builder
+	b.WriteString("# Managed by vercelredirect. Changes to this file will be overwritten.\n")
+	b.WriteString(p.SiteAddress + " {\n")
+	for _, config := range enabled {
+		if config.Host == "" {
+			continue
+		}
+		b.WriteString(fmt.Sprintf("\t@%s {\n\t\thost %s\n", config.Ref(), config.Host))
+		if config.PathPrefix != "" {
+			b.WriteString(fmt.Sprintf("\t\tpath %s*\n", config.PathPrefix))
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("\troute {\n")
+	for _, config := range enabled {
+		target := config.TargetURL
+		if !config.DropQueryString {
+			target += "{?query}"
+		}
+		matcher := ""
+		if config.Host != "" {
+			matcher = "@" + config.Ref() + " "
+		}
+		b.WriteString(fmt.Sprintf("\t\tredir %s%s %d\n", matcher, target, config.EffectiveStatusCode()))
+	}
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+func toRedirectRuleset(rules []caddyRedirectRule) RedirectRuleset {
+	var ruleset RedirectRuleset
+	for _, rule := range rules {
+		redirectRule := RedirectRule{
+			ID:          rule.Config.Ref(),
+			Action:      "redirect",
+			Expression:  rule.Config.Expression(),
+			Description: fmt.Sprintf("%s Redirect %s to %s", botRedirectRuleTag, rule.Config.Source(), rule.Config.TargetURL),
+			LastUpdated: rule.LastUpdated,
+			Ref:         rule.Config.Ref(),
+			Enabled:     rule.Enabled,
+		}
+		redirectRule.ActionParameters.FromValue.StatusCode = rule.Config.EffectiveStatusCode()
+		redirectRule.ActionParameters.FromValue.TargetURL.Value = rule.Config.TargetURL
+		redirectRule.ActionParameters.FromValue.PreserveQueryString = !rule.Config.DropQueryString
+		ruleset.Rules = append(ruleset.Rules, redirectRule)
+	}
+	return ruleset
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// reloadCaddy runs CADDY_RELOAD_COMMAND, if set, so Caddy picks up the new
+// snippet.
+func reloadCaddy() error {
+	command := os.Getenv("CADDY_RELOAD_COMMAND")
+	if command == "" {
+		return nil
+	}
+	output, err := exec.Command("sh", "-c", command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error reloading caddy: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// CloudflareRedirectProvider manages the dynamic redirect rules of a
+// Cloudflare zone.
+type CloudflareRedirectProvider struct {
+	ZoneID string
+	Token  string
+	ctx    context.Context
+}
+
+func (p *CloudflareRedirectProvider) Name() string {
+	return "cloudflare"
+}
+
+func (p *CloudflareRedirectProvider) request(method, url string, payload interface{}) (int, []byte, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		jsonPayload, err := json.Marshal(payload)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error marshaling JSON: %v", err)
+		}
+		reqBody = bytes.NewBuffer(jsonPayload)
+	}
+
+	req, err := http.NewRequestWithContext(p.ctx, method, url, reqBody)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error creating request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	statusCode, body, err := sendWithRetry(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error sending request: %v", err)
+	}
+
+	return statusCode, body, nil
+}
+
+// getRuleset returns the zone's dynamic redirect entrypoint ruleset. A zone
+// without an entrypoint yields an empty ruleset with no ID.
+func (p *CloudflareRedirectProvider) getRuleset() (RedirectRuleset, error) {
+	url := fmt.Sprintf("%s/zones/%s/rulesets/phases/http_request_dynamic_redirect/entrypoint", cloudflareAPIURL, p.ZoneID)
+
+	statusCode, body, err := p.request("GET", url, nil)
+	if err != nil {
+		return RedirectRuleset{}, err
+	}
+
+	if statusCode == http.StatusNotFound {
+		return RedirectRuleset{}, nil
+	}
+	if statusCode != http.StatusOK {
+		return RedirectRuleset{}, fmt.Errorf("API request failed with status code %d: %s", statusCode, string(body))
+	}
+
+	var redirectRulesResp RedirectRulesResponse
+	err = json.Unmarshal(body, &redirectRulesResp)
+	if err != nil {
+		return RedirectRuleset{}, fmt.Errorf("error unmarshaling response: %v", err)
+	}
+
+	return redirectRulesResp.Result, nil
+}
+
+func (p *CloudflareRedirectProvider) ListRules() ([]RedirectRule, error) {
+	ruleset, err := p.getRuleset()
+	if err != nil {
+		return nil, err
+	}
+	return ruleset.Rules, nil
+}
+
+// SetRedirect points the bot-owned redirect rule for the scope of config at
+// its target URL. Only that rule is created or updated; every other rule in
+// the zone is left untouched.
+func (p *CloudflareRedirectProvider) SetRedirect(config RedirectConfig) error {
+	if err := validateRedirectScope(config); err != nil {
+		return err
+	}
+	if err := validateRedirectTarget(config); err != nil {
+		return err
+	}
+	if !isValidRedirectStatusCode(config.EffectiveStatusCode()) {
+		return fmt.Errorf("unsupported redirect status code %d", config.StatusCode)
+	}
+
+	rule := RedirectRuleRequest{
+		Action:      "redirect",
+		Expression:  config.Expression(),
+		Description: fmt.Sprintf("%s Redirect %s to %s", botRedirectRuleTag, config.Source(), config.TargetURL),
+		Ref:         config.Ref(),
+		Enabled:     true,
+	}
+	rule.ActionParameters.FromValue.StatusCode = config.EffectiveStatusCode()
+	rule.ActionParameters.FromValue.TargetURL.Value = config.TargetURL
+	rule.ActionParameters.FromValue.PreserveQueryString = !config.DropQueryString
+
+	ruleset, err := p.getRuleset()
+	if err != nil {
+		return fmt.Errorf("error fetching current redirect rules: %v", err)
+	}
+
+	var method, url string
+	var payload interface{}
+	if ruleset.ID == "" {
+		// The zone has no redirect entrypoint yet, so create it with our rule.
+		method = "PUT"
+		url = fmt.Sprintf("%s/zones/%s/rulesets/phases/http_request_dynamic_redirect/entrypoint", cloudflareAPIURL, p.ZoneID)
+		payload = map[string]interface{}{
+			"rules": []RedirectRuleRequest{rule},
+		}
+	} else {
+		method = "POST"
+		url = fmt.Sprintf("%s/zones/%s/rulesets/%s/rules", cloudflareAPIURL, p.ZoneID, ruleset.ID)
+		position := len(ruleset.Rules)
+		for i, existing := range ruleset.Rules {
+			if existing.Ref == rule.Ref || (isBotRedirectRule(existing) && existing.Expression == rule.Expression) {
+				method = "PATCH"
+				url = fmt.Sprintf("%s/zones/%s/rulesets/%s/rules/%s", cloudflareAPIURL, p.ZoneID, ruleset.ID, existing.ID)
+				position = i
+				break
+			}
+		}
+		// The first matching rule wins, so the rule is moved before any bot
+		// rule with a broader scope that would otherwise handle its traffic.
+		for _, existing := range ruleset.Rules[:position] {
+			if isBotRedirectRule(existing) && config.isShadowedBy(existing.Expression) {
+				rule.Position = &RedirectRulePosition{Before: existing.ID}
+				break
+			}
+		}
+		payload = rule
+	}
+
+	statusCode, body, err := p.request(method, url, payload)
+	if err != nil {
+		return err
+	}
+
+	if statusCode != http.StatusOK {
+		return fmt.Errorf("API request failed with status code %d: %s", statusCode, string(body))
+	}
+
+	return nil
+}
+
+func (p *CloudflareRedirectProvider) DeleteRule(selector string) (RedirectRule, error) {
+	ruleset, err := p.getRuleset()
+	if err != nil {
+		return RedirectRule{}, fmt.Errorf("error fetching current redirect rules: %v", err)
+	}
+	rule, err := findRedirectRule(ruleset, selector)
+	if err != nil {
+		return RedirectRule{}, err
+	}
+
+	url := fmt.Sprintf("%s/zones/%s/rulesets/%s/rules/%s", cloudflareAPIURL, p.ZoneID, ruleset.ID, rule.ID)
+	statusCode, body, err := p.request("DELETE", url, nil)
+	if err != nil {
+		return RedirectRule{}, err
+	}
+	if statusCode != http.StatusOK {
+		return RedirectRule{}, fmt.Errorf("API request failed with status code %d: %s", statusCode, string(body))
+	}
+
+	return rule, nil
+}
+
+func (p *CloudflareRedirectProvider) SetRuleEnabled(selector string, enabled bool) (RedirectRule, error) {
+	ruleset, err := p.getRuleset()
+	if err != nil {
+		return RedirectRule{}, fmt.Errorf("error fetching current redirect rules: %v", err)
+	}
+	rule, err := findRedirectRule(ruleset, selector)
+	if err != nil {
+		return RedirectRule{}, err
+	}
+
+	// The rule is sent back unchanged apart from its enabled flag.
+	payload := RedirectRuleRequest{
+		Action:           rule.Action,
+		Expression:       rule.Expression,
+		Description:      rule.Description,
+		Ref:              rule.Ref,
+		Enabled:          enabled,
+		ActionParameters: rule.ActionParameters,
+	}
+	url := fmt.Sprintf("%s/zones/%s/rulesets/%s/rules/%s", cloudflareAPIURL, p.ZoneID, ruleset.ID, rule.ID)
+	statusCode, body, err := p.request("PATCH", url, payload)
+	if err != nil {
+		return RedirectRule{}, err
+	}
+	if statusCode != http.StatusOK {
+		return RedirectRule{}, fmt.Errorf("API request failed with status code %d: %s", statusCode, string(body))
+	}
+
+	rule.Enabled = enabled
+	return rule, nil
+}
+
+type cloudflareAPIResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func (response cloudflareAPIResponse) errorText() string {
+	var messages []string
+	for _, apiErr := range response.Errors {
+		messages = append(messages, fmt.Sprintf("%s (code %d)", apiErr.Message, apiErr.Code))
+	}
+	return strings.Join(messages, "; ")
+}
+
+// CheckCredentials verifies that the token is active and, if a zone ID is
+// set, that the zone exists and the token may read its dynamic redirect
+// rules. Whether the token may also edit them can only be seen when a rule
+// is written.
+func (p *CloudflareRedirectProvider) CheckCredentials() error {
+	statusCode, body, err := p.request("GET", cloudflareAPIURL+"/user/tokens/verify", nil)
+	if err != nil {
+		return fmt.Errorf("could not reach Cloudflare to check the token: %v", err)
+	}
+	var verify cloudflareAPIResponse
+	json.Unmarshal(body, &verify)
+	if statusCode != http.StatusOK || !verify.Success {
+		return fmt.Errorf("the Cloudflare token is invalid: %s", verify.errorText())
+	}
+	var token struct {
+		Status string `json:"status"`
+	}
+	json.Unmarshal(verify.Result, &token)
+	if token.Status != "active" {
+		return fmt.Errorf("the Cloudflare token is %s, not active", token.Status)
+	}
+
+	if p.ZoneID == "" {
+		return nil
+	}
+
+	// Tokens limited to redirect rules usually cannot read zone details, so a
+	// 403 here is only reported together with a failed ruleset check.
+	statusCode, body, err = p.request("GET", fmt.Sprintf("%s/zones/%s", cloudflareAPIURL, p.ZoneID), nil)
+	if err != nil {
+		return fmt.Errorf("could not reach Cloudflare to check the zone: %v", err)
+	}
+	zoneReadable := statusCode == http.StatusOK
+	if statusCode == http.StatusNotFound || statusCode == http.StatusBadRequest {
+		return fmt.Errorf("there is no Cloudflare zone with ID %q; copy the Zone ID from the Overview page of your domain in the Cloudflare dashboard", p.ZoneID)
+	}
+
+	url := fmt.Sprintf("%s/zones/%s/rulesets/phases/http_request_dynamic_redirect/entrypoint", cloudflareAPIURL, p.ZoneID)
+	statusCode, body, err = p.request("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("could not reach Cloudflare to check the redirect rules: %v", err)
+	}
+	var ruleset cloudflareAPIResponse
+	json.Unmarshal(body, &ruleset)
+	switch {
+	case statusCode == http.StatusOK, statusCode == http.StatusNotFound:
+		return nil
+	case statusCode == http.StatusBadRequest:
+		return fmt.Errorf("there is no Cloudflare zone with ID %q: %s", p.ZoneID, ruleset.errorText())
+	case statusCode == http.StatusForbidden && zoneReadable:
+		return fmt.Errorf("the Cloudflare token can read zone %s but lacks the Zone > Dynamic Redirect permission needed to manage redirect rules", p.ZoneID)
+	case statusCode == http.StatusForbidden:
+		return fmt.Errorf("the Cloudflare token cannot access zone %q; check the Zone ID and that the token has the Zone > Dynamic Redirect permission with this zone included in its Zone Resources", p.ZoneID)
+	default:
+		return fmt.Errorf("unexpected response from Cloudflare while checking the redirect rules (status code %d): %s", statusCode, ruleset.errorText())
+	}
+}
@@ -1,267 +1,303 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"math/rand"
-	"net/http"
-	"strconv"
-	"strings"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	"github.com/tidwall/buntdb"
 )
 
-func getVercelDomains(projectId, vercelToken string) ([]string, error) {
-	url := fmt.Sprintf("%s/v9/projects/%s/domains", vercelAPIURL, projectId)
-
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Authorization", "Bearer "+vercelToken)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// autoRedirectLoop rotates the job's domain until it is stopped or fails. It
+// returns true when it was interrupted by a bot shutdown, in which case the
+// persisted job must be kept so it resumes on restart.
+func autoRedirectLoop(bot *tgbotapi.BotAPI, job *AutoRedirectJob, stopChan chan bool, controlChan chan autoRedirectControl) bool {
+	chatID, userID, username := job.ChatID, job.UserID, job.Username
+	schedule, err := job.schedule()
 	if err != nil {
-		return nil, err
+		sendErrorAndStop(bot, chatID, userID, username, "❌ Invalid schedule for job "+job.ID, err)
+		return false
 	}
-	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get Vercel domains: %s", string(body))
-	}
+	for {
+		if stopped, shutdown := waitForRotation(job, schedule, stopChan, controlChan); stopped || shutdown {
+			return shutdown
+		}
 
-	var result struct {
-		Domains []struct {
-			Name string `json:"name"`
-		} `json:"domains"`
-	}
-	json.Unmarshal(body, &result)
+		tokens, err := getProfileTokens(userID, job.Profile)
+		if err != nil {
+			sendErrorAndStop(bot, chatID, userID, username, "❌ Error loading the API tokens of profile "+job.Profile, err)
+			return false
+		}
 
-	domains := make([]string, len(result.Domains))
-	for i, domain := range result.Domains {
-		domains[i] = domain.Name
-	}
+		hosting, err := newHostingProvider(autoRedirectContext, tokens)
+		if err != nil {
+			sendErrorAndStop(bot, chatID, userID, username, "❌ Error loading the hosting provider of profile "+job.Profile, err)
+			return false
+		}
 
-	return domains, nil
-}
+		provider, err := newRedirectProvider(autoRedirectContext, userID, job.Profile, tokens)
+		if err != nil {
+			sendErrorAndStop(bot, chatID, userID, username, "❌ Error loading the redirect provider of profile "+job.Profile, err)
+			return false
+		}
 
-func addVercelDomain(projectId, newDomain, vercelToken string) error {
-	url := fmt.Sprintf("%s/v9/projects/%s/domains", vercelAPIURL, projectId)
+		rotate := rotateDomain
+		if len(job.Pool) > 0 {
+			rotate = rotatePoolDomain
+		}
+		if err := rotate(job, hosting, provider, stopChan); err != nil {
+			// Requests cancelled by a shutdown fail as well. The checkpoint
+			// lets the resumed job finish or undo the rotation.
+			if isShuttingDown() {
+				return true
+			}
+			if !errors.Is(err, errHealthCheckFailed) {
+				sendErrorAndStop(bot, chatID, userID, username, "❌ "+err.Error(), err)
+				return false
+			}
+			// An unhealthy domain only skips this rotation; a pending domain
+			// left by a failed rollback is removed by the next one.
+			job.NextRun = schedule.Next(time.Now())
+			checkpointAutoRedirectJob(job, stopChan)
+			warningMsg := fmt.Sprintf("⚠️ Auto-redirect job %s skipped this update: %s\nNext update at %s (in %s).", job.ID, err.Error(), formatNextRun(job.NextRun), formatScheduleDuration(time.Until(job.NextRun).Round(time.Minute)))
+			bot.Send(tgbotapi.NewMessage(chatID, warningMsg))
+			logError(userID, username, "Auto-redirect update skipped", err)
+			continue
+		}
 
-	payload := map[string]string{
-		"name": newDomain,
-	}
-	jsonPayload, _ := json.Marshal(payload)
+		job.NextRun = schedule.Next(time.Now())
+		checkpointAutoRedirectJob(job, stopChan)
 
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonPayload))
-	req.Header.Set("Authorization", "Bearer "+vercelToken)
-	req.Header.Set("Content-Type", "application/json")
+		currentTime := time.Now().UTC().Format("2006-01-02 15:04:05 MST")
+		messageText := fmt.Sprintf("🔄 Auto-redirect updated at %s. New domain: %s. Next update at %s (in %s).", currentTime, job.CurrentDomain, formatNextRun(job.NextRun), formatScheduleDuration(time.Until(job.NextRun).Round(time.Minute)))
+		msg := tgbotapi.NewMessage(chatID, messageText)
+		if _, err := bot.Send(msg); err != nil {
+			errorMsg := "❌ Error sending update message"
+			sendErrorAndStop(bot, chatID, userID, username, errorMsg, err)
+			return false
+		}
+		logInfo(userID, username, fmt.Sprintf("Auto-redirect updated. New domain: %s", job.CurrentDomain))
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+		// Stale domains stay queued in the checkpoint for the next rotation.
+		if isShuttingDown() {
+			return true
+		}
+		if err := removeStaleDomains(job, hosting, stopChan); err != nil {
+			warningMsg := fmt.Sprintf("⚠️ Could not delete the previous domain, it will be retried on the next update: %s", err.Error())
+			bot.Send(tgbotapi.NewMessage(chatID, warningMsg))
+			logError(userID, username, "Error deleting previous domain", err)
+		}
 	}
-	defer resp.Body.Close()
+}
 
-	body, _ := io.ReadAll(resp.Body)
+// waitForRotation blocks until the job's next rotation is due or /rotatenow
+// is used, handling pause and resume requests in the meantime. A resumed job
+// waits for the rotation that was scheduled before the restart. It reports
+// whether the job was stopped or the bot is shutting down instead.
+func waitForRotation(job *AutoRedirectJob, schedule Schedule, stopChan chan bool, controlChan chan autoRedirectControl) (stopped, shutdown bool) {
+	for job.Paused || time.Until(job.NextRun) > 0 {
+		var due <-chan time.Time
+		var timer *time.Timer
+		if !job.Paused {
+			timer = time.NewTimer(time.Until(job.NextRun))
+			due = timer.C
+		}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to add Vercel domain: %s", string(body))
+		rotate := false
+		select {
+		case <-due:
+			rotate = true
+		case control := <-controlChan:
+			switch control {
+			case controlRotateNow:
+				rotate = true
+			case controlPause:
+				job.Paused = true
+			case controlResume:
+				job.Paused = false
+				if job.NextRun.Before(time.Now()) {
+					job.NextRun = schedule.Next(time.Now())
+				}
+			}
+			checkpointAutoRedirectJob(job, stopChan)
+		case <-stopChan:
+			stopped = true
+		case <-autoRedirectContext.Done():
+			shutdown = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if rotate || stopped || shutdown {
+			return stopped, shutdown
+		}
 	}
-
-	return nil
+	return false, false
 }
 
-func deleteVercelDomain(projectId, domain, vercelToken string) error {
-	domains, err := getVercelDomains(projectId, vercelToken)
-	if err != nil {
-		return fmt.Errorf("failed to get current domains: %v", err)
+// rotateDomain moves the job to a freshly generated domain in the order add,
+// verify, health check, switch redirect, so the redirect never points at a
+// domain that does not exist. If any of these steps fails the new domain is
+// removed again and the redirect keeps pointing at the current domain, unless
+// a failed redirect update turns out to have been applied. The previous
+// domain is queued in StaleDomains and deleted by removeStaleDomains
+// afterwards.
+func rotateDomain(job *AutoRedirectJob, hosting HostingProvider, provider RedirectProvider, stopChan chan bool) error {
+	if err := checkGeneratedDomainSupport(hosting); err != nil {
+		return err
 	}
 
-	if len(domains) <= 1 {
-		return fmt.Errorf("cannot delete the last remaining domain")
+	// A rotation interrupted after switching the redirect but before its
+	// checkpoint is finished here; otherwise the pending domain is unused.
+	if job.PendingDomain != "" {
+		target, err := currentRedirectTarget(provider, job.Redirect)
+		if err != nil {
+			return fmt.Errorf("error checking the redirect left by an interrupted update: %v", err)
+		}
+		if target == "https://"+job.PendingDomain {
+			switchToPendingDomain(job)
+		} else if err := hosting.RemoveDomain(job.PendingDomain); err != nil {
+			return fmt.Errorf("error removing domain %s left by an interrupted update: %v", job.PendingDomain, err)
+		}
+		job.PendingDomain = ""
+		checkpointAutoRedirectJob(job, stopChan)
 	}
 
-	url := fmt.Sprintf("%s/v9/projects/%s/domains/%s", vercelAPIURL, projectId, domain)
-
-	req, _ := http.NewRequest("DELETE", url, nil)
-	req.Header.Set("Authorization", "Bearer "+vercelToken)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	newDomain, err := addGeneratedDomain(job, hosting)
 	if err != nil {
-		return err
+		return fmt.Errorf("error adding new domain, make sure your %s api token and project id is correct: %v", hosting.Name(), err)
 	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to delete Vercel domain: %s", string(body))
+	job.PendingDomain = newDomain
+	checkpointAutoRedirectJob(job, stopChan)
+	if isShuttingDown() {
+		return errAutoRedirectShutdown
 	}
 
-	return nil
-}
-
-func getCloudflareRedirectRules(zoneID, cloudflareToken string) ([]RedirectRule, error) {
-	url := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/rulesets/phases/http_request_dynamic_redirect/entrypoint", zoneID)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
+	if err := verifyDomainAdded(hosting, newDomain); err != nil {
+		return rollbackDomain(job, hosting, stopChan, fmt.Errorf("error verifying new domain %s: %v", newDomain, err))
 	}
-
-	req.Header.Set("Authorization", "Bearer "+cloudflareToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error sending request: %v", err)
+	if isShuttingDown() {
+		return errAutoRedirectShutdown
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
+	if err := runHealthProbe(autoRedirectContext, job.Probe, newDomain); err != nil {
+		if isShuttingDown() {
+			return errAutoRedirectShutdown
+		}
+		return rollbackDomain(job, hosting, stopChan, fmt.Errorf("new domain %s is not healthy: %w", newDomain, err))
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API request failed with status code %d: %s", resp.StatusCode, string(body))
+	if isShuttingDown() {
+		return errAutoRedirectShutdown
 	}
 
-	var redirectRulesResp RedirectRulesResponse
-	err = json.Unmarshal(body, &redirectRulesResp)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling response: %v", err)
+	redirect := job.Redirect
+	redirect.TargetURL = "https://" + newDomain
+	if err := provider.SetRedirect(redirect); err != nil {
+		setErr := fmt.Errorf("error setting redirect, make sure your %s settings are correct: %v", provider.Name(), err)
+		// The update may have been applied with only the response lost, in
+		// which case the new domain is already in use and must be kept.
+		target, checkErr := currentRedirectTarget(provider, job.Redirect)
+		if checkErr != nil {
+			return fmt.Errorf("%v\n⚠️ The redirect could not be checked afterwards (%v), so the new domain %s was kept", setErr, checkErr, newDomain)
+		}
+		if target != redirect.TargetURL {
+			return rollbackDomain(job, hosting, stopChan, setErr)
+		}
 	}
 
-	return redirectRulesResp.Result.Rules, nil
+	switchToPendingDomain(job)
+	checkpointAutoRedirectJob(job, stopChan)
+	return nil
 }
 
-func setRedirect(targetURL, zoneID, cloudflareToken string) error {
-	url := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/rulesets/phases/http_request_dynamic_redirect/entrypoint", zoneID)
-
-	rule := RedirectRule{
-		Action:      "redirect",
-		Expression:  "true",
-		Description: fmt.Sprintf("Redirect to %s", targetURL),
-		Enabled:     true,
-		ActionParameters: struct {
-			FromValue struct {
-				StatusCode int `json:"status_code"`
-				TargetURL  struct {
-					Value string `json:"value"`
-				} `json:"target_url"`
-				PreserveQueryString bool `json:"preserve_query_string"`
-			} `json:"from_value"`
-		}{
-			FromValue: struct {
-				StatusCode int `json:"status_code"`
-				TargetURL  struct {
-					Value string `json:"value"`
-				} `json:"target_url"`
-				PreserveQueryString bool `json:"preserve_query_string"`
-			}{
-				StatusCode: 301,
-				TargetURL: struct {
-					Value string `json:"value"`
-				}{
-					Value: targetURL,
-				},
-				PreserveQueryString: true,
-			},
-		},
-	}
-
-	payload := map[string]interface{}{
-		"rules": []RedirectRule{rule},
+// switchToPendingDomain records that the redirect now points to the pending
+// domain and queues the previous domain for deletion.
+func switchToPendingDomain(job *AutoRedirectJob) {
+	if job.CurrentDomain != "" {
+		job.StaleDomains = append(job.StaleDomains, job.CurrentDomain)
 	}
+	job.CurrentDomain = job.PendingDomain
+	job.PendingDomain = ""
+}
 
-	jsonPayload, err := json.Marshal(payload)
+// currentRedirectTarget returns the target URL of the bot-owned rule for the
+// scope of config, or "" if there is no such rule.
+func currentRedirectTarget(provider RedirectProvider, config RedirectConfig) (string, error) {
+	rules, err := provider.ListRules()
 	if err != nil {
-		return fmt.Errorf("error marshaling JSON: %v", err)
+		return "", err
 	}
-
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		return fmt.Errorf("error creating request: %v", err)
+	for _, rule := range rules {
+		if rule.Ref == config.Ref() || (isBotRedirectRule(rule) && rule.Expression == config.Expression()) {
+			return rule.ActionParameters.FromValue.TargetURL.Value, nil
+		}
 	}
+	return "", nil
+}
 
-	req.Header.Set("Authorization", "Bearer "+cloudflareToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+func verifyDomainAdded(hosting HostingProvider, domain string) error {
+	domains, err := hosting.ListDomains()
 	if err != nil {
-		return fmt.Errorf("error sending request: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("error reading response body: %v", err)
+	for _, existing := range domains {
+		if existing == domain {
+			return nil
+		}
 	}
+	return fmt.Errorf("the domain is not listed by %s", hosting.Name())
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("API request failed with status code %d: %s", resp.StatusCode, string(body))
+// rollbackDomain removes the pending domain after a failed rotation and
+// returns cause, annotated with the outcome of the rollback.
+func rollbackDomain(job *AutoRedirectJob, hosting HostingProvider, stopChan chan bool, cause error) error {
+	current := job.CurrentDomain
+	if current == "" {
+		current = "its previous target"
 	}
-
-	return nil
+	if err := hosting.RemoveDomain(job.PendingDomain); err != nil {
+		return fmt.Errorf("%w\n⚠️ Rollback failed, the new domain %s could not be removed: %v. The redirect still points to %s", cause, job.PendingDomain, err, current)
+	}
+	removed := job.PendingDomain
+	job.PendingDomain = ""
+	checkpointAutoRedirectJob(job, stopChan)
+	return fmt.Errorf("%w\n↩️ Rolled back: the new domain %s was removed and the redirect still points to %s", cause, removed, current)
 }
 
-func autoRedirectLoop(bot *tgbotapi.BotAPI, chatID int64, userID int64, username, seedText string, tokens UserTokens, RedirectRefresh int, stopChan chan bool) {
-	ticker := time.NewTicker(time.Duration(RedirectRefresh) * time.Minute)
-	defer ticker.Stop()
-
-	tempPreviousDomain := ""
-
-	for {
-		newDomain := generateRandomDomain(seedText)
-
-		if tempPreviousDomain != "" {
-			if err := deleteVercelDomain(tokens.VercelProjectID, tempPreviousDomain, tokens.VercelToken); err != nil {
-				errorMsg := "❌ Error deleting previous domain, make sure your vercel api token and project id is correct \n " + err.Error()
-				sendErrorAndStop(bot, chatID, userID, username, errorMsg, err)
-				return
+// removeStaleDomains deletes domains the redirect no longer points to. Domains
+// that cannot be deleted stay queued for the next rotation.
+func removeStaleDomains(job *AutoRedirectJob, hosting HostingProvider, stopChan chan bool) error {
+	var remaining []string
+	var firstErr error
+	for _, domain := range job.StaleDomains {
+		if err := hosting.RemoveDomain(domain); err != nil {
+			remaining = append(remaining, domain)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v", domain, err)
 			}
 		}
+	}
+	job.StaleDomains = remaining
+	checkpointAutoRedirectJob(job, stopChan)
+	return firstErr
+}
 
-		if err := addVercelDomain(tokens.VercelProjectID, newDomain, tokens.VercelToken); err != nil {
-			errorMsg := "❌ Error adding new domain, make sure your vercel api token and project id is correct \n " + err.Error()
-			sendErrorAndStop(bot, chatID, userID, username, errorMsg, err)
-			return
-		}
-
-		if err := setRedirect("https://"+newDomain, tokens.CloudflareZoneID, tokens.CloudflareToken); err != nil {
-			errorMsg := "❌ Error setting redirect, make sure your cloudflare api token and zone id is correct \n" + err.Error()
-			sendErrorAndStop(bot, chatID, userID, username, errorMsg, err)
-			return
-		}
-
-		currentTime := time.Now().UTC().Format("2006-01-02 15:04:05 MST")
-		messageText := fmt.Sprintf("🔄 Auto-redirect updated at %s. New domain: %s. It will update in %d minutes.", currentTime, newDomain, RedirectRefresh)
-		msg := tgbotapi.NewMessage(chatID, messageText)
-		if _, err := bot.Send(msg); err != nil {
-			errorMsg := "❌ Error sending update message"
-			sendErrorAndStop(bot, chatID, userID, username, errorMsg, err)
-			return
-		}
-		logInfo(userID, username, fmt.Sprintf("Auto-redirect updated. New domain: %s", newDomain))
-
-		tempPreviousDomain = newDomain
-
-		select {
-		case <-ticker.C:
-			// Continue to the next iteration
-		case <-stopChan:
-			return
-		}
+// checkpointAutoRedirectJob persists the job state unless the job has been
+// stopped, so a stopped job is not written back after /stopautoredirect. The
+// check and the save happen under autoRedirectLock, which stopAutoRedirect
+// holds while it closes stopChan and deletes the job.
+func checkpointAutoRedirectJob(job *AutoRedirectJob, stopChan chan bool) {
+	autoRedirectLock.Lock()
+	defer autoRedirectLock.Unlock()
+
+	select {
+	case <-stopChan:
+		return
+	default:
+	}
+	if err := saveAutoRedirectJob(job); err != nil {
+		logError(job.UserID, job.Username, "Error saving auto-redirect job", err)
 	}
 }
 
@@ -277,49 +313,3 @@ func sendErrorAndStop(bot *tgbotapi.BotAPI, chatID int64, userID int64, username
 		logError(userID, username, "Error sending stop message", sendErr)
 	}
 }
-
-func generateRandomDomain(seedText string) string {
-	rand.Seed(time.Now().UnixNano())
-	randomString := fmt.Sprintf("%s-%d", seedText, rand.Intn(10000))
-	return fmt.Sprintf("%s.vercel.app", randomString)
-}
-
-func whitelistUser(userID int64) error {
-	return db.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(fmt.Sprintf("whitelist:%d", userID), "true", nil)
-		return err
-	})
-}
-
-func isWhitelisted(userID int64) bool {
-	var whitelisted bool
-	db.View(func(tx *buntdb.Tx) error {
-		_, err := tx.Get(fmt.Sprintf("whitelist:%d", userID))
-		whitelisted = (err == nil)
-		return nil
-	})
-	return whitelisted
-}
-
-func deleteWhitelistedUser(userID int64) error {
-	return db.Update(func(tx *buntdb.Tx) error {
-		_, err := tx.Delete(fmt.Sprintf("whitelist:%d", userID))
-		return err
-	})
-}
-
-func getAllWhitelistedUsers() ([]int64, error) {
-	var whitelistedUsers []int64
-	err := db.View(func(tx *buntdb.Tx) error {
-		return tx.Ascend("", func(key, value string) bool {
-			if strings.HasPrefix(key, "whitelist:") {
-				userID, err := strconv.ParseInt(strings.TrimPrefix(key, "whitelist:"), 10, 64)
-				if err == nil {
-					whitelistedUsers = append(whitelistedUsers, userID)
-				}
-			}
-			return true
-		})
-	})
-	return whitelistedUsers, err
-}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// checkCredentials verifies the credentials of the given services ("vercel",
+// "cloudflare" or "netlify") in tokens against their APIs. Services whose
+// token is not set yet are skipped; the returned notes list them, and what
+// could only be checked in part, so the user knows what was stored unchecked.
+func checkCredentials(ctx context.Context, tokens UserTokens, services ...string) ([]string, error) {
+	var notes []string
+	for _, service := range services {
+		var err error
+		switch service {
+		case "vercel":
+			if tokens.VercelToken == "" {
+				if tokens.VercelProjectID != "" {
+					notes = append(notes, "The Vercel Project ID will be checked once your Vercel token is set.")
+				}
+				continue
+			}
+			err = (&VercelHostingProvider{ProjectID: tokens.VercelProjectID, Token: tokens.VercelToken, ctx: ctx}).CheckCredentials()
+		case "cloudflare":
+			if tokens.CloudflareToken == "" {
+				if tokens.CloudflareZoneID != "" {
+					notes = append(notes, "The Cloudflare Zone ID will be checked once your Cloudflare token is set.")
+				}
+				continue
+			}
+			err = (&CloudflareRedirectProvider{ZoneID: tokens.CloudflareZoneID, Token: tokens.CloudflareToken, ctx: ctx}).CheckCredentials()
+			if err == nil && tokens.CloudflareZoneID != "" {
+				notes = append(notes, "Cloudflare only lets the bot check that the token can read the zone's redirect rules. Make sure it can also edit them (Zone > Dynamic Redirect > Edit); otherwise setting the first redirect fails.")
+			}
+		case "netlify":
+			if tokens.NetlifyToken == "" {
+				if tokens.NetlifySiteID != "" {
+					notes = append(notes, "The Netlify Site ID will be checked once your Netlify token is set.")
+				}
+				continue
+			}
+			err = (&NetlifyHostingProvider{SiteID: tokens.NetlifySiteID, Token: tokens.NetlifyToken, ctx: ctx}).CheckCredentials()
+		default:
+			err = fmt.Errorf("unknown service %q", service)
+		}
+		if err != nil {
+			return notes, err
+		}
+	}
+	return notes, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+)
+
+// Token records are envelope-encrypted: every record gets its own random data
+// key which seals the JSON blob, and that data key is in turn sealed with the
+// master key taken from TOKEN_ENCRYPTION_KEY. Stored values look like
+// "enc:v1:<sealed data key>:<sealed blob>" with both parts base64 encoded.
+const encryptedTokenPrefix = "enc:v1:"
+
+var masterKey []byte
+
+func loadMasterKey(encodedKey string) error {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return fmt.Errorf("master key is not valid base64: %v", err)
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+	}
+	masterKey = key
+	return nil
+}
+
+func isEncryptedTokenBlob(value string) bool {
+	return strings.HasPrefix(value, encryptedTokenPrefix)
+}
+
+// encryptTokenBlob seals plaintext for the given database key. The key is used
+// as additional authenticated data so a sealed value cannot be copied to
+// another user's record.
+func encryptTokenBlob(dbKey string, plaintext []byte) (string, error) {
+	if masterKey == nil {
+		return "", errors.New("master key is not loaded")
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", fmt.Errorf("error generating data key: %v", err)
+	}
+
+	sealedKey, err := sealAESGCM(masterKey, dataKey, []byte(dbKey))
+	if err != nil {
+		return "", fmt.Errorf("error sealing data key: %v", err)
+	}
+	sealedBlob, err := sealAESGCM(dataKey, plaintext, []byte(dbKey))
+	if err != nil {
+		return "", fmt.Errorf("error sealing token blob: %v", err)
+	}
+
+	return encryptedTokenPrefix +
+		base64.StdEncoding.EncodeToString(sealedKey) + ":" +
+		base64.StdEncoding.EncodeToString(sealedBlob), nil
+}
+
+func decryptTokenBlob(dbKey, value string) ([]byte, error) {
+	if masterKey == nil {
+		return nil, errors.New("master key is not loaded")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedTokenPrefix), ":")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed encrypted token blob")
+	}
+	sealedKey, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding data key: %v", err)
+	}
+	sealedBlob, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding token blob: %v", err)
+	}
+
+	dataKey, err := openAESGCM(masterKey, sealedKey, []byte(dbKey))
+	if err != nil {
+		return nil, fmt.Errorf("error opening data key (wrong master key?): %v", err)
+	}
+	return openAESGCM(dataKey, sealedBlob, []byte(dbKey))
+}
+
+func sealAESGCM(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openAESGCM(key, sealed, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// migratePlaintextTokens re-encrypts every token record that was written
+// before encryption at rest was introduced. It is safe to run on every start.
+func migratePlaintextTokens() (int, error) {
+	migrated := 0
+	err := db.Update(func(tx *buntdb.Tx) error {
+		plaintext := make(map[string]string)
+		for _, pattern := range []string{"user:*", "profile:*"} {
+			err := tx.AscendKeys(pattern, func(key, value string) bool {
+				if !isEncryptedTokenBlob(value) {
+					plaintext[key] = value
+				}
+				return true
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for key, value := range plaintext {
+			sealed, err := encryptTokenBlob(key, []byte(value))
+			if err != nil {
+				return err
+			}
+			if _, _, err := tx.Set(key, sealed, nil); err != nil {
+				return err
+			}
+			migrated++
+		}
+		return nil
+	})
+	return migrated, err
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DomainTemplate describes how an auto-redirect job names the domains it
+// adds. The zero value appends a random number to the seed, like
+// "seed-4821".
+//
+//   - number: seed-4821
+//   - words:  seed-brave-otter, picked from Words or a built-in word list
+//   - date:   seed-20240131-0930, the UTC time of the rotation
+//   - hex:    seed-9f3a2c, with HexLength random hex digits
+type DomainTemplate struct {
+	Style     string   `json:"style,omitempty"`
+	HexLength int      `json:"hex_length,omitempty"`
+	Words     []string `json:"words,omitempty"`
+}
+
+const (
+	defaultDomainHexLength = 6
+	maxDomainNameAttempts  = 5
+	maxDomainLabelLength   = 63
+)
+
+// errDomainTaken is wrapped by HostingProvider.AddDomain when the domain is
+// already in use, typically by another project or account.
+var errDomainTaken = errors.New("domain is already taken")
+
+var (
+	domainLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+	domainAdjectives = []string{
+		"amber", "bold", "brave", "bright", "calm", "clever", "cosmic", "crisp",
+		"eager", "fancy", "gentle", "golden", "happy", "lively", "lucky", "mellow",
+		"misty", "noble", "proud", "quick", "quiet", "rapid", "royal", "shiny",
+		"silent", "silver", "sunny", "swift", "vivid", "witty",
+	}
+	domainNouns = []string{
+		"badger", "breeze", "canyon", "cedar", "comet", "coral", "falcon", "forest",
+		"harbor", "heron", "island", "lagoon", "maple", "meadow", "meteor", "orbit",
+		"otter", "panda", "pebble", "pine", "planet", "raven", "river", "summit",
+		"tiger", "valley", "willow", "wolf", "zenith", "zephyr",
+	}
+)
+
+func (template DomainTemplate) style() string {
+	if template.Style == "" {
+		return "number"
+	}
+	return template.Style
+}
+
+func (template DomainTemplate) hexLength() int {
+	if template.HexLength == 0 {
+		return defaultDomainHexLength
+	}
+	return template.HexLength
+}
+
+func (template DomainTemplate) String() string {
+	switch template.style() {
+	case "words":
+		if len(template.Words) > 0 {
+			return fmt.Sprintf("seed + words from %s", strings.Join(template.Words, ", "))
+		}
+		return "seed + two random words"
+	case "date":
+		return "seed + date"
+	case "hex":
+		return fmt.Sprintf("seed + %d hex characters", template.hexLength())
+	default:
+		return "seed + random number"
+	}
+}
+
+// suffix returns the part appended to the seed. attempt counts the names
+// already rejected in this rotation, so deterministic styles can still move
+// on to a different name.
+func (template DomainTemplate) suffix(now time.Time, attempt int) string {
+	switch template.style() {
+	case "words":
+		if len(template.Words) > 0 {
+			return template.Words[mathrand.Intn(len(template.Words))] + "-" + strconv.Itoa(mathrand.Intn(100))
+		}
+		return domainAdjectives[mathrand.Intn(len(domainAdjectives))] + "-" + domainNouns[mathrand.Intn(len(domainNouns))]
+	case "date":
+		suffix := now.UTC().Format("20060102-1504")
+		if attempt > 0 {
+			suffix += "-" + strconv.Itoa(attempt+1)
+		}
+		return suffix
+	case "hex":
+		buf := make([]byte, (template.hexLength()+1)/2)
+		if _, err := rand.Read(buf); err != nil {
+			// crypto/rand does not fail on supported platforms.
+			panic(err)
+		}
+		return hex.EncodeToString(buf)[:template.hexLength()]
+	default:
+		return strconv.Itoa(mathrand.Intn(10000))
+	}
+}
+
+// generate returns a domain name below baseDomain for the given seed.
+func (template DomainTemplate) generate(seedText, baseDomain string, now time.Time, attempt int) string {
+	suffix := template.suffix(now, attempt)
+	seed := strings.ToLower(seedText)
+	if maxSeed := maxDomainLabelLength - len(suffix) - 1; len(seed) > maxSeed {
+		seed = strings.TrimRight(seed[:maxSeed], "-")
+	}
+	return fmt.Sprintf("%s-%s.%s", seed, suffix, baseDomain)
+}
+
+// applyDomainTemplateFlags reads the --name* options of /startautoredirect
+// into template.
+func applyDomainTemplateFlags(flags map[string]string, template *DomainTemplate) error {
+	if value, ok := flags["name"]; ok {
+		switch value {
+		case "number", "words", "date", "hex":
+			template.Style = value
+		default:
+			return fmt.Errorf("name must be number, words, date or hex")
+		}
+	}
+	if value, ok := flags["name-length"]; ok {
+		if template.style() != "hex" {
+			return fmt.Errorf("name-length only applies to --name=hex")
+		}
+		length, err := strconv.Atoi(value)
+		if err != nil || length < 4 || length > 32 {
+			return fmt.Errorf("name-length must be between 4 and 32")
+		}
+		template.HexLength = length
+	}
+	if value, ok := flags["name-words"]; ok {
+		if template.style() != "words" {
+			return fmt.Errorf("name-words only applies to --name=words")
+		}
+		var words []string
+		for _, word := range strings.Split(strings.ToLower(value), ",") {
+			word = strings.TrimSpace(word)
+			if !domainLabelPattern.MatchString(word) || len(word) > 20 {
+				return fmt.Errorf("name-words must be a comma-separated list of words using a-z, 0-9 and -")
+			}
+			words = append(words, word)
+		}
+		template.Words = words
+	}
+	return nil
+}
+
+// isValidDomainSeed reports whether seedText can start a domain label.
+func isValidDomainSeed(seedText string) bool {
+	return len(seedText) <= 40 && domainLabelPattern.MatchString(strings.ToLower(seedText))
+}
+
+// checkGeneratedDomainSupport refuses hosting providers that cannot serve a
+// generated domain next to the current one.
+func checkGeneratedDomainSupport(hosting HostingProvider) error {
+	if !hosting.KeepsGeneratedDomains() {
+		return fmt.Errorf("the %s hosting provider cannot add a new %s domain without dropping the current one, so auto-redirect jobs on %s need a domain pool (--pool)", hosting.Name(), hosting.BaseDomain(), hosting.Name())
+	}
+	return nil
+}
+
+// addGeneratedDomain adds a freshly named domain for job to hosting. Names
+// already used by the project or by any auto-redirect job are skipped, and a
+// name the hosting provider reports as taken is replaced by a new one, up to
+// maxDomainNameAttempts times.
+func addGeneratedDomain(job *AutoRedirectJob, hosting HostingProvider) (string, error) {
+	existing, err := hosting.ListDomains()
+	if err != nil {
+		return "", err
+	}
+	used := make(map[string]bool)
+	for _, domain := range existing {
+		used[domain] = true
+	}
+	jobs, err := getAllAutoRedirectJobs()
+	if err != nil {
+		return "", err
+	}
+	for _, other := range jobs {
+		used[other.CurrentDomain] = true
+		used[other.PendingDomain] = true
+		for _, domain := range other.StaleDomains {
+			used[domain] = true
+		}
+	}
+
+	now := time.Now()
+	var lastErr error
+	for attempt := 0; attempt < maxDomainNameAttempts; attempt++ {
+		domain := job.Naming.generate(job.SeedText, hosting.BaseDomain(), now, attempt)
+		if used[domain] {
+			continue
+		}
+		err := hosting.AddDomain(domain)
+		if err == nil {
+			return domain, nil
+		}
+		if !errors.Is(err, errDomainTaken) {
+			return "", err
+		}
+		// A retried request may have added the domain before failing.
+		if verifyDomainAdded(hosting, domain) == nil {
+			return domain, nil
+		}
+		used[domain] = true
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("every generated name was already in use")
+	}
+	return "", fmt.Errorf("no free domain name found after %d attempts: %v", maxDomainNameAttempts, lastErr)
+}
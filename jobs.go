@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/tidwall/buntdb"
+)
+
+// AutoRedirectJob is the persisted state of a running auto-redirect rotation.
+// It is checkpointed after every step of rotateDomain so a restarted bot can
+// resume the job and still clean up the domains it created. CurrentDomain is
+// the domain the redirect points to, PendingDomain one that was added but not
+// switched to yet and StaleDomains previous domains still waiting to be
+// deleted. Redirect holds the scope and options of the rule the job updates;
+// its TargetURL is filled in on every rotation. Jobs with a Pool switch
+// between the pool's domains instead of generating new ones. Schedule is the
+// schedule text the job was started with; jobs saved before schedules existed
+// only have RefreshMinutes.
+type AutoRedirectJob struct {
+	ID             string         `json:"id"`
+	UserID         int64          `json:"user_id"`
+	ChatID         int64          `json:"chat_id"`
+	Username       string         `json:"username"`
+	Profile        string         `json:"profile"`
+	SeedText       string         `json:"seed_text"`
+	Naming         DomainTemplate `json:"naming"`
+	Pool           []string       `json:"pool,omitempty"`
+	PoolOrder      string         `json:"pool_order,omitempty"`
+	RefreshMinutes int            `json:"refresh_minutes,omitempty"`
+	Schedule       string         `json:"schedule,omitempty"`
+	Redirect       RedirectConfig `json:"redirect"`
+	Probe          HealthProbe    `json:"probe"`
+	CurrentDomain  string         `json:"current_domain"`
+	PendingDomain  string         `json:"pending_domain,omitempty"`
+	StaleDomains   []string       `json:"stale_domains,omitempty"`
+	NextRun        time.Time      `json:"next_run"`
+	Paused         bool           `json:"paused,omitempty"`
+}
+
+var (
+	// autoRedirectContext is cancelled when the bot shuts down. Running loops
+	// stop after the step of the rotation in progress, leaving their
+	// checkpoint in place, and API requests they are waiting for are
+	// cancelled.
+	autoRedirectContext, cancelAutoRedirects = context.WithCancel(context.Background())
+	autoRedirectWG                           sync.WaitGroup
+)
+
+// errAutoRedirectShutdown is returned by a rotation that stopped between two
+// steps because the bot is shutting down. The checkpoint records how far it
+// got, and the resumed job finishes or undoes the rotation.
+var errAutoRedirectShutdown = errors.New("the bot is shutting down")
+
+func isShuttingDown() bool {
+	select {
+	case <-autoRedirectContext.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdownAutoRedirects asks every running loop to stop after its current
+// step and waits for them for at most timeout. It returns how many jobs
+// were running and whether all of them stopped in time.
+func shutdownAutoRedirects(timeout time.Duration) (int, bool) {
+	autoRedirectLock.Lock()
+	running := len(autoRedirectJobs)
+	cancelAutoRedirects()
+	autoRedirectLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		autoRedirectWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return running, true
+	case <-time.After(timeout):
+		return running, false
+	}
+}
+
+// autoRedirectHandle is the registry entry of a running job. The job state
+// itself is owned by its loop; readers use the persisted copy instead.
+// Paused mirrors the state requested through controlChan so commands can
+// answer without waiting for a loop that is busy rotating.
+type autoRedirectHandle struct {
+	UserID      int64
+	Profile     string
+	Paused      bool
+	stopChan    chan bool
+	controlChan chan autoRedirectControl
+}
+
+// autoRedirectControl is a request sent to a running autoRedirectLoop.
+type autoRedirectControl int
+
+const (
+	// controlRotateNow rotates immediately, even while paused, and then
+	// continues with the schedule.
+	controlRotateNow autoRedirectControl = iota
+	// controlPause suspends scheduled rotations. The current domain and
+	// redirect stay in place.
+	controlPause
+	// controlResume continues scheduled rotations. A rotation missed while
+	// paused is not caught up; the next one follows the schedule.
+	controlResume
+)
+
+func newAutoRedirectJobID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(b)
+}
+
+func autoRedirectJobKey(jobID string) string {
+	return "autoredirect:" + jobID
+}
+
+func saveAutoRedirectJob(job *AutoRedirectJob) error {
+	jsonJob, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(autoRedirectJobKey(job.ID), string(jsonJob), nil)
+		return err
+	})
+}
+
+func deleteAutoRedirectJob(jobID string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(autoRedirectJobKey(jobID))
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func getAllAutoRedirectJobs() ([]*AutoRedirectJob, error) {
+	var jobs []*AutoRedirectJob
+	err := db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys("autoredirect:*", func(key, value string) bool {
+			var job AutoRedirectJob
+			if err := json.Unmarshal([]byte(value), &job); err != nil {
+				log.Printf("[ERROR] Skipping unreadable auto-redirect job %s: %v", key, err)
+				return true
+			}
+			jobs = append(jobs, &job)
+			return true
+		})
+	})
+	return jobs, err
+}
+
+// migrateLegacyAutoRedirectJobs re-keys jobs saved before job IDs existed,
+// which were stored per user (and later per profile) instead of per job.
+func migrateLegacyAutoRedirectJobs() error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		legacy := make(map[string]AutoRedirectJob)
+		err := tx.AscendKeys("autoredirect:*", func(key, value string) bool {
+			var job AutoRedirectJob
+			if json.Unmarshal([]byte(value), &job) == nil && job.ID == "" {
+				legacy[key] = job
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		for key, job := range legacy {
+			job.ID = newAutoRedirectJobID()
+			if job.Profile == "" {
+				job.Profile = defaultProfileName
+			}
+			jsonJob, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Delete(key); err != nil {
+				return err
+			}
+			if _, _, err := tx.Set(autoRedirectJobKey(job.ID), string(jsonJob), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// getUserAutoRedirectJobs returns the jobs userID started and the jobs of the
+// teams userID belongs to.
+func getUserAutoRedirectJobs(userID int64) ([]*AutoRedirectJob, error) {
+	jobs, err := getAllAutoRedirectJobs()
+	if err != nil {
+		return nil, err
+	}
+	var userJobs []*AutoRedirectJob
+	for _, job := range jobs {
+		if canAccessJob(userID, job.UserID, job.Profile, roleViewer) {
+			userJobs = append(userJobs, job)
+		}
+	}
+	sort.Slice(userJobs, func(i, j int) bool { return userJobs[i].NextRun.Before(userJobs[j].NextRun) })
+	return userJobs, nil
+}
+
+// startAutoRedirect registers the job and runs autoRedirectLoop in the
+// background. The caller must hold autoRedirectLock.
+func startAutoRedirect(bot *tgbotapi.BotAPI, job *AutoRedirectJob) error {
+	if job.ID == "" {
+		job.ID = newAutoRedirectJobID()
+	}
+	if err := saveAutoRedirectJob(job); err != nil {
+		return err
+	}
+
+	handle := &autoRedirectHandle{
+		UserID:      job.UserID,
+		Profile:     job.Profile,
+		Paused:      job.Paused,
+		stopChan:    make(chan bool),
+		controlChan: make(chan autoRedirectControl, 1),
+	}
+	autoRedirectJobs[job.ID] = handle
+
+	autoRedirectWG.Add(1)
+	go func() {
+		defer autoRedirectWG.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				errorMsg := fmt.Sprintf("🛑 Unexpected error occurred in job %s: %v", job.ID, r)
+				msg := tgbotapi.NewMessage(job.ChatID, errorMsg)
+				bot.Send(msg)
+
+				// Clean up the auto-redirect
+				finishAutoRedirect(job.ID, handle)
+
+				stopMsg := tgbotapi.NewMessage(job.ChatID, "🛑 Auto-redirect stopped due to an unexpected error. Use /jobs to check your remaining jobs.")
+				bot.Send(stopMsg)
+			}
+		}()
+		if autoRedirectLoop(bot, job, handle.stopChan, handle.controlChan) {
+			// Interrupted by a shutdown: keep the checkpoint for the next start.
+			logInfo(job.UserID, job.Username, fmt.Sprintf("Auto-redirect job %s checkpointed for shutdown", job.ID))
+			return
+		}
+
+		// Clean up after autoRedirectLoop finishes (due to error or stop signal)
+		finishAutoRedirect(job.ID, handle)
+	}()
+
+	return nil
+}
+
+// stopAutoRedirect signals a running job owned by userID, or by a team userID
+// operates, to stop and removes its persisted state.
+func stopAutoRedirect(userID int64, jobID string) error {
+	autoRedirectLock.Lock()
+	defer autoRedirectLock.Unlock()
+
+	handle, exists := autoRedirectJobs[jobID]
+	if !exists || !canAccessJob(userID, handle.UserID, handle.Profile, roleOperator) {
+		return fmt.Errorf("no running job with ID %s", jobID)
+	}
+	close(handle.stopChan)
+	delete(autoRedirectJobs, jobID)
+	return deleteAutoRedirectJob(jobID)
+}
+
+// controlAutoRedirect sends control to a running job owned by userID or by a
+// team userID operates.
+func controlAutoRedirect(userID int64, jobID string, control autoRedirectControl) error {
+	autoRedirectLock.Lock()
+	defer autoRedirectLock.Unlock()
+
+	handle, exists := autoRedirectJobs[jobID]
+	if !exists || !canAccessJob(userID, handle.UserID, handle.Profile, roleOperator) {
+		return fmt.Errorf("no running job with ID %s", jobID)
+	}
+	switch {
+	case control == controlPause && handle.Paused:
+		return fmt.Errorf("job %s is already paused", jobID)
+	case control == controlResume && !handle.Paused:
+		return fmt.Errorf("job %s is not paused", jobID)
+	}
+
+	select {
+	case handle.controlChan <- control:
+	default:
+		return fmt.Errorf("job %s is still handling a previous request, please try again in a moment", jobID)
+	}
+	switch control {
+	case controlPause:
+		handle.Paused = true
+	case controlResume:
+		handle.Paused = false
+	}
+	return nil
+}
+
+// finishAutoRedirect forgets a job whose loop has ended. The registry entry is
+// only removed if it still belongs to this loop.
+func finishAutoRedirect(jobID string, handle *autoRedirectHandle) {
+	autoRedirectLock.Lock()
+	defer autoRedirectLock.Unlock()
+
+	if current, exists := autoRedirectJobs[jobID]; exists && current != handle {
+		return
+	}
+	delete(autoRedirectJobs, jobID)
+	if err := deleteAutoRedirectJob(jobID); err != nil {
+		log.Printf("[ERROR] Failed to delete auto-redirect job %s: %v", jobID, err)
+	}
+}
+
+// resumeAutoRedirectJobs restarts every job that was running when the bot
+// last stopped.
+func resumeAutoRedirectJobs(bot *tgbotapi.BotAPI) {
+	if err := migrateLegacyAutoRedirectJobs(); err != nil {
+		log.Printf("[ERROR] Failed to migrate auto-redirect jobs: %v", err)
+	}
+
+	jobs, err := getAllAutoRedirectJobs()
+	if err != nil {
+		log.Printf("[ERROR] Failed to load auto-redirect jobs: %v", err)
+		return
+	}
+
+	autoRedirectLock.Lock()
+	defer autoRedirectLock.Unlock()
+
+	for _, job := range jobs {
+		if err := startAutoRedirect(bot, job); err != nil {
+			logError(job.UserID, job.Username, "Failed to resume auto-redirect", err)
+			continue
+		}
+		logInfo(job.UserID, job.Username, fmt.Sprintf("Auto-redirect job %s resumed. Current domain: %s", job.ID, job.CurrentDomain))
+
+		text := fmt.Sprintf("♻️ Auto-redirect job %s (profile %s) resumed after a bot restart. Next update at %s.", job.ID, job.Profile, formatNextRun(job.NextRun))
+		if job.Paused {
+			text = fmt.Sprintf("♻️ Auto-redirect job %s (profile %s) restored after a bot restart. It is still paused; use /resumeautoredirect %s to resume it.", job.ID, job.Profile, job.ID)
+		}
+		msg := tgbotapi.NewMessage(job.ChatID, text)
+		bot.Send(msg)
+	}
+}
+
+// schedule parses the rotation schedule of the job.
+func (job *AutoRedirectJob) schedule() (Schedule, error) {
+	if job.Schedule == "" {
+		return parseSchedule(strconv.Itoa(job.RefreshMinutes))
+	}
+	return parseSchedule(job.Schedule)
+}
+
+func formatNextRun(nextRun time.Time) string {
+	if nextRun.Before(time.Now()) {
+		return "now"
+	}
+	return nextRun.UTC().Format("2006-01-02 15:04:05 MST")
+}
@@ -2,10 +2,16 @@ package main
 
 import "log"
 
+// logInfo and logError redact registered secrets before anything is written;
+// see redactSecrets.
 func logInfo(userID int64, username, message string) {
-	log.Printf("[INFO] [User: %d | @%s] %s", userID, username, message)
+	log.Printf("[INFO] [User: %d | @%s] %s", userID, username, redactSecrets(message))
 }
 
 func logError(userID int64, username, message string, err error) {
-	log.Printf("[ERROR] [User: %d | @%s] %s: %v", userID, username, message, err)
+	errText := "<nil>"
+	if err != nil {
+		errText = err.Error()
+	}
+	log.Printf("[ERROR] [User: %d | @%s] %s: %s", userID, username, redactSecrets(message), redactSecrets(errText))
 }
@@ -1,27 +1,72 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joho/godotenv"
 )
 
+// shutdownDrainTimeout bounds how long a shutdown waits for running
+// auto-redirect rotations to reach a checkpoint.
+const shutdownDrainTimeout = 30 * time.Second
+
 func main() {
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
 
+	// Log lines written outside logInfo and logError, e.g. by the Telegram
+	// client, are redacted too.
+	registerEnvSecrets()
+	log.SetOutput(redactingWriter{w: os.Stderr})
+
 	telegramToken := os.Getenv("TELEGRAM_TOKEN")
 	if telegramToken == "" {
 		log.Fatal("TELEGRAM_TOKEN environment variable is not set")
 	}
 
-	secretCode = os.Getenv("SECRET_CODE")
-	if secretCode == "" {
-		panic("SECRET_CODE environment variable is not set")
+	if err := loadMasterKey(os.Getenv("TOKEN_ENCRYPTION_KEY")); err != nil {
+		log.Fatal("TOKEN_ENCRYPTION_KEY is invalid: ", err)
+	}
+
+	if err := loadRetryPolicy(); err != nil {
+		log.Fatal("Invalid retry policy: ", err)
+	}
+
+	encrypted, err := migratePlaintextTokens()
+	if err != nil {
+		log.Fatal("Failed to encrypt stored tokens: ", err)
+	}
+	if encrypted > 0 {
+		log.Printf("[INFO] Encrypted %d plaintext token records", encrypted)
+	}
+
+	moved, err := migrateLegacyUserTokens()
+	if err != nil {
+		log.Fatal("Failed to migrate stored tokens to profiles: ", err)
+	}
+	if moved > 0 {
+		log.Printf("[INFO] Moved %d token records into default profiles", moved)
+	}
+
+	// buntdb only appends to its file, so the replaced plaintext records stay
+	// on disk until the file is rewritten.
+	if encrypted+moved > 0 {
+		if err := db.Shrink(); err != nil {
+			log.Fatal("Failed to compact the database after migrating tokens: ", err)
+		}
+		log.Printf("[INFO] Compacted the database to remove the old token records")
+	}
+
+	if err := bootstrapRoles(); err != nil {
+		log.Fatal("Failed to set up roles: ", err)
 	}
 
 	bot, err := tgbotapi.NewBotAPI(telegramToken)
@@ -31,18 +76,72 @@ func main() {
 
 	bot.Debug = false
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	resumeAutoRedirectJobs(bot)
+
+	updates, stopUpdates, err := startUpdates(bot)
+	if err != nil {
+		log.Fatal("Failed to start receiving updates: ", err)
+	}
 
-	updates := bot.GetUpdatesChan(u)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	for update := range updates {
-		if update.Message == nil {
-			continue
+receive:
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				break receive
+			}
+			dispatchUpdate(ctx, bot, update)
+		case <-ctx.Done():
+			break receive
 		}
+	}
+
+	// A second signal kills the bot immediately.
+	stop()
+	log.Printf("[INFO] Shutting down")
+	stopUpdates()
 
-		if update.Message.IsCommand() {
-			handleTelegramCommand(bot, update)
+	// Handle updates that were already received before the shutdown. ctx is
+	// cancelled by now, so their API requests get a context of their own.
+drain:
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				break drain
+			}
+			dispatchUpdate(context.Background(), bot, update)
+		default:
+			break drain
 		}
 	}
+
+	log.Printf("[INFO] Stopped receiving updates, draining auto-redirect jobs")
+	running, drained := shutdownAutoRedirects(shutdownDrainTimeout)
+	if !drained {
+		// Closing the database would make the remaining loops lose the
+		// checkpoints they are still writing; every written checkpoint is
+		// already in the file.
+		log.Printf("[ERROR] Timed out after %s waiting for %d auto-redirect jobs; they resume from their last checkpoint", shutdownDrainTimeout, running)
+		return
+	}
+	log.Printf("[INFO] %d auto-redirect jobs checkpointed", running)
+
+	if err := db.Close(); err != nil {
+		log.Printf("[ERROR] Failed to close database: %v", err)
+	}
+	log.Printf("[INFO] Shutdown complete")
+}
+
+func dispatchUpdate(ctx context.Context, bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+	if update.Message == nil {
+		return
+	}
+
+	if update.Message.IsCommand() {
+		handleTelegramCommand(ctx, bot, update)
+	}
 }
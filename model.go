@@ -3,30 +3,62 @@ package main
 import "time"
 
 const vercelAPIURL = "https://api.vercel.com"
+const cloudflareAPIURL = "https://api.cloudflare.com/client/v4"
+
+// botRedirectRuleRef marks the dynamic redirect rule managed by the bot so it
+// can be updated without touching the other rules of the zone.
+const botRedirectRuleRef = "vercelredirect_bot"
+const botRedirectRuleTag = "[vercelredirect]"
+const legacyBotRedirectDescription = "Redirect to "
+
 type RedirectRule struct {
-	ID               string    `json:"id"`
-	Version          string    `json:"version"`
-	Action           string    `json:"action"`
-	Expression       string    `json:"expression"`
-	Description      string    `json:"description"`
-	LastUpdated      time.Time `json:"last_updated"`
-	Ref              string    `json:"ref"`
-	Enabled          bool      `json:"enabled"`
-	ActionParameters struct {
-		FromValue struct {
-			StatusCode int `json:"status_code"`
-			TargetURL  struct {
-				Value string `json:"value"`
-			} `json:"target_url"`
-			PreserveQueryString bool `json:"preserve_query_string"`
-		} `json:"from_value"`
-	} `json:"action_parameters"`
+	ID               string                   `json:"id"`
+	Version          string                   `json:"version"`
+	Action           string                   `json:"action"`
+	Expression       string                   `json:"expression"`
+	Description      string                   `json:"description"`
+	LastUpdated      time.Time                `json:"last_updated"`
+	Ref              string                   `json:"ref"`
+	Enabled          bool                     `json:"enabled"`
+	ActionParameters RedirectActionParameters `json:"action_parameters"`
+}
+
+type RedirectActionParameters struct {
+	FromValue RedirectFromValue `json:"from_value"`
+}
+
+type RedirectFromValue struct {
+	StatusCode int `json:"status_code"`
+	TargetURL  struct {
+		Value string `json:"value"`
+	} `json:"target_url"`
+	PreserveQueryString bool `json:"preserve_query_string"`
+}
+
+// RedirectRuleRequest is the writable part of a RedirectRule, sent when a
+// rule is created or updated.
+type RedirectRuleRequest struct {
+	Action           string                   `json:"action"`
+	Expression       string                   `json:"expression"`
+	Description      string                   `json:"description"`
+	Ref              string                   `json:"ref,omitempty"`
+	Enabled          bool                     `json:"enabled"`
+	ActionParameters RedirectActionParameters `json:"action_parameters"`
+	Position         *RedirectRulePosition    `json:"position,omitempty"`
+}
+
+// RedirectRulePosition moves a rule that is created or updated before the
+// rule with the given ID.
+type RedirectRulePosition struct {
+	Before string `json:"before"`
+}
+
+type RedirectRuleset struct {
+	ID    string         `json:"id"`
+	Rules []RedirectRule `json:"rules"`
 }
 
 type RedirectRulesResponse struct {
-	Result struct {
-		ID    string         `json:"id"`
-		Rules []RedirectRule `json:"rules"`
-	} `json:"result"`
-	Success bool `json:"success"`
+	Result  RedirectRuleset `json:"result"`
+	Success bool            `json:"success"`
 }
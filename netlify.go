@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const netlifyAPIURL = "https://api.netlify.com/api/v1"
+
+// NetlifyHostingProvider manages the domains of a Netlify site. A site has a
+// single *.netlify.app domain, so adding a new one renames the site and the
+// previous *.netlify.app domain stops resolving at the same moment. Other
+// domains are managed as domain aliases of the site. Because of the rename,
+// auto-redirect jobs on Netlify can only rotate through a domain pool.
+type NetlifyHostingProvider struct {
+	SiteID string
+	Token  string
+	ctx    context.Context
+}
+
+type netlifySite struct {
+	Name          string   `json:"name"`
+	DefaultDomain string   `json:"default_domain"`
+	CustomDomain  string   `json:"custom_domain"`
+	DomainAliases []string `json:"domain_aliases"`
+}
+
+func (p *NetlifyHostingProvider) Name() string {
+	return "netlify"
+}
+
+// request sends a request for the site and returns the status code and the
+// site in the response. Responses other than 200 are also returned as an
+// error; the status code is 0 if no response was received.
+func (p *NetlifyHostingProvider) request(method string, payload interface{}) (int, netlifySite, error) {
+	var site netlifySite
+	url := fmt.Sprintf("%s/sites/%s", netlifyAPIURL, p.SiteID)
+
+	var reqBody io.Reader
+	if payload != nil {
+		jsonPayload, err := json.Marshal(payload)
+		if err != nil {
+			return 0, site, fmt.Errorf("error marshaling JSON: %v", err)
+		}
+		reqBody = bytes.NewBuffer(jsonPayload)
+	}
+
+	req, err := http.NewRequestWithContext(p.ctx, method, url, reqBody)
+	if err != nil {
+		return 0, site, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	statusCode, body, err := sendWithRetry(req)
+	if err != nil {
+		return 0, site, err
+	}
+
+	if statusCode != http.StatusOK {
+		return statusCode, site, fmt.Errorf("Netlify API request failed with status code %d: %s", statusCode, string(body))
+	}
+
+	err = json.Unmarshal(body, &site)
+	return statusCode, site, err
+}
+
+func (p *NetlifyHostingProvider) ListDomains() ([]string, error) {
+	_, site, err := p.request("GET", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Netlify domains: %v", err)
+	}
+
+	domains := []string{site.DefaultDomain}
+	if site.CustomDomain != "" {
+		domains = append(domains, site.CustomDomain)
+	}
+	return append(domains, site.DomainAliases...), nil
+}
+
+func (p *NetlifyHostingProvider) AddDomain(newDomain string) error {
+	if name, ok := strings.CutSuffix(newDomain, ".netlify.app"); ok {
+		if statusCode, _, err := p.request("PATCH", map[string]string{"name": name}); err != nil {
+			// Netlify rejects names used by another site with a 422.
+			if statusCode == http.StatusUnprocessableEntity {
+				return fmt.Errorf("failed to rename Netlify site: %w: %v", errDomainTaken, err)
+			}
+			return fmt.Errorf("failed to rename Netlify site: %v", err)
+		}
+		return nil
+	}
+
+	_, site, err := p.request("GET", nil)
+	if err != nil {
+		return fmt.Errorf("failed to get Netlify domains: %v", err)
+	}
+	aliases := append(site.DomainAliases, newDomain)
+	if _, _, err := p.request("PATCH", map[string][]string{"domain_aliases": aliases}); err != nil {
+		return fmt.Errorf("failed to add Netlify domain: %v", err)
+	}
+	return nil
+}
+
+func (p *NetlifyHostingProvider) RemoveDomain(domain string) error {
+	_, site, err := p.request("GET", nil)
+	if err != nil {
+		return fmt.Errorf("failed to get Netlify domains: %v", err)
+	}
+
+	if strings.HasSuffix(domain, ".netlify.app") {
+		if domain == site.DefaultDomain {
+			return fmt.Errorf("cannot delete the site's current netlify.app domain")
+		}
+		// The domain was released when the site was renamed.
+		return nil
+	}
+
+	var aliases []string
+	found := false
+	for _, alias := range site.DomainAliases {
+		if alias == domain {
+			found = true
+			continue
+		}
+		aliases = append(aliases, alias)
+	}
+	if !found {
+		return fmt.Errorf("domain %s is not an alias of the Netlify site", domain)
+	}
+	if _, _, err := p.request("PATCH", map[string][]string{"domain_aliases": aliases}); err != nil {
+		return fmt.Errorf("failed to delete Netlify domain: %v", err)
+	}
+	return nil
+}
+
+func (p *NetlifyHostingProvider) BaseDomain() string {
+	return "netlify.app"
+}
+
+// KeepsGeneratedDomains is false because adding a *.netlify.app domain
+// renames the site, so the current domain stops resolving before the
+// redirect is switched and cannot be restored by removing the new one.
+func (p *NetlifyHostingProvider) KeepsGeneratedDomains() bool {
+	return false
+}
+
+// CheckCredentials verifies that the token is valid and, if a site ID is
+// set, that the site is visible to it.
+func (p *NetlifyHostingProvider) CheckCredentials() error {
+	req, _ := http.NewRequestWithContext(p.ctx, "GET", netlifyAPIURL+"/user", nil)
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+
+	statusCode, body, err := sendWithRetry(req)
+	if err != nil {
+		return fmt.Errorf("could not reach Netlify to check the token: %v", err)
+	}
+	switch statusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("the Netlify token is invalid, expired or revoked")
+	default:
+		return fmt.Errorf("unexpected response from Netlify while checking the token (status code %d): %s", statusCode, string(body))
+	}
+
+	if p.SiteID == "" {
+		return nil
+	}
+	if statusCode, _, err := p.request("GET", nil); err != nil {
+		if statusCode == http.StatusNotFound {
+			return fmt.Errorf("no Netlify site with ID %q is visible to this token; use the Site ID (API ID) from the site's configuration page", p.SiteID)
+		}
+		return fmt.Errorf("error checking the Netlify site: %v", err)
+	}
+	return nil
+}
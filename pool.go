@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Pool orders for auto-redirect jobs that cycle through a domain pool
+// instead of generating new domains.
+const (
+	poolOrderRoundRobin = "roundrobin"
+	poolOrderRandom     = "random"
+)
+
+// applyPoolFlags reads the --pool options of /startautoredirect into job.
+// --pool takes a comma-separated list of domains already attached to the
+// hosting project, --pool-order chooses how the next one is picked.
+func applyPoolFlags(flags map[string]string, job *AutoRedirectJob) error {
+	value, ok := flags["pool"]
+	if !ok {
+		if _, ok := flags["pool-order"]; ok {
+			return fmt.Errorf("pool-order requires --pool")
+		}
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var pool []string
+	for _, domain := range strings.Split(value, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			continue
+		}
+		if len(domain) > 253 || !hostnamePattern.MatchString(domain) {
+			return fmt.Errorf("invalid pool domain %q", domain)
+		}
+		if !seen[domain] {
+			seen[domain] = true
+			pool = append(pool, domain)
+		}
+	}
+	if len(pool) < 2 {
+		return fmt.Errorf("pool needs at least two domains")
+	}
+	job.Pool = pool
+
+	switch order := flags["pool-order"]; order {
+	case "", "roundrobin", "round-robin":
+		job.PoolOrder = poolOrderRoundRobin
+	case "random":
+		job.PoolOrder = poolOrderRandom
+	default:
+		return fmt.Errorf("pool-order must be roundrobin or random")
+	}
+	return nil
+}
+
+// checkPoolDomains makes sure every pool member is attached to the hosting
+// project, so a job does not fail later when it reaches a missing one.
+func checkPoolDomains(hosting HostingProvider, pool []string) error {
+	domains, err := hosting.ListDomains()
+	if err != nil {
+		return err
+	}
+	attached := make(map[string]bool)
+	for _, domain := range domains {
+		attached[domain] = true
+	}
+	var missing []string
+	for _, domain := range pool {
+		if !attached[domain] {
+			missing = append(missing, domain)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("not attached to your %s project: %s", hosting.Name(), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// poolCandidates returns the pool members to try next, in order of
+// preference. The current domain is never among them.
+func poolCandidates(job *AutoRedirectJob) []string {
+	var candidates []string
+	if job.PoolOrder == poolOrderRandom {
+		for _, i := range rand.Perm(len(job.Pool)) {
+			if job.Pool[i] != job.CurrentDomain {
+				candidates = append(candidates, job.Pool[i])
+			}
+		}
+		return candidates
+	}
+
+	start := 0
+	for i, domain := range job.Pool {
+		if domain == job.CurrentDomain {
+			start = i + 1
+			break
+		}
+	}
+	for i := 0; i < len(job.Pool); i++ {
+		domain := job.Pool[(start+i)%len(job.Pool)]
+		if domain != job.CurrentDomain {
+			candidates = append(candidates, domain)
+		}
+	}
+	return candidates
+}
+
+// rotatePoolDomain switches the redirect to the next healthy member of the
+// job's pool. Pool members are never added or removed; a member that is not
+// attached to the project or fails the health check is skipped.
+func rotatePoolDomain(job *AutoRedirectJob, hosting HostingProvider, provider RedirectProvider, stopChan chan bool) error {
+	var failures []string
+	for _, domain := range poolCandidates(job) {
+		if isShuttingDown() {
+			return errAutoRedirectShutdown
+		}
+		if err := verifyDomainAdded(hosting, domain); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", domain, err))
+			continue
+		}
+		if err := runHealthProbe(autoRedirectContext, job.Probe, domain); err != nil {
+			failures = append(failures, fmt.Sprintf("%s is not healthy: %v", domain, err))
+			continue
+		}
+
+		redirect := job.Redirect
+		redirect.TargetURL = "https://" + domain
+		if err := provider.SetRedirect(redirect); err != nil {
+			return fmt.Errorf("error setting redirect, make sure your %s settings are correct: %v", provider.Name(), err)
+		}
+		job.CurrentDomain = domain
+		checkpointAutoRedirectJob(job, stopChan)
+		return nil
+	}
+	// Like an unhealthy generated domain, this only skips the rotation.
+	return fmt.Errorf("%w for every pool member, the redirect was left unchanged:\n%s", errHealthCheckFailed, strings.Join(failures, "\n"))
+}
+
+func (job *AutoRedirectJob) poolDescription() string {
+	order := "round-robin"
+	if job.PoolOrder == poolOrderRandom {
+		order = "random"
+	}
+	return fmt.Sprintf("%s (%s)", strings.Join(job.Pool, ", "), order)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HealthProbe describes the HTTP check run against a new domain before the
+// redirect is switched to it. The zero value probes "/" once plus two retries
+// and expects a 200 response within 10 seconds.
+type HealthProbe struct {
+	Disabled       bool   `json:"disabled,omitempty"`
+	Path           string `json:"path,omitempty"`
+	ExpectedStatus int    `json:"expected_status,omitempty"`
+	BodyContains   string `json:"body_contains,omitempty"`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"`
+	Retries        int    `json:"retries,omitempty"`
+}
+
+const (
+	defaultProbeStatus  = http.StatusOK
+	defaultProbeTimeout = 10
+	defaultProbeRetries = 2
+	probeRetryDelay     = 5 * time.Second
+	probeBodyLimit      = 1 << 20
+)
+
+func (probe HealthProbe) expectedStatus() int {
+	if probe.ExpectedStatus == 0 {
+		return defaultProbeStatus
+	}
+	return probe.ExpectedStatus
+}
+
+func (probe HealthProbe) timeout() time.Duration {
+	if probe.TimeoutSeconds == 0 {
+		return defaultProbeTimeout * time.Second
+	}
+	return time.Duration(probe.TimeoutSeconds) * time.Second
+}
+
+func (probe HealthProbe) retries() int {
+	if probe.Retries == 0 {
+		return defaultProbeRetries
+	}
+	if probe.Retries < 0 {
+		return 0
+	}
+	return probe.Retries
+}
+
+func (probe HealthProbe) path() string {
+	if probe.Path == "" {
+		return "/"
+	}
+	return probe.Path
+}
+
+func (probe HealthProbe) String() string {
+	if probe.Disabled {
+		return "off"
+	}
+	description := fmt.Sprintf("GET %s expecting %d", probe.path(), probe.expectedStatus())
+	if probe.BodyContains != "" {
+		description += fmt.Sprintf(" containing %q", probe.BodyContains)
+	}
+	return fmt.Sprintf("%s, %s timeout, %d retries", description, probe.timeout(), probe.retries())
+}
+
+// applyProbeFlags reads the --probe* options of /startautoredirect into probe.
+func applyProbeFlags(flags map[string]string, probe *HealthProbe) error {
+	if value, ok := flags["probe"]; ok {
+		switch value {
+		case "on", "true":
+			probe.Disabled = false
+		case "off":
+			probe.Disabled = true
+		default:
+			return fmt.Errorf("probe must be on or off")
+		}
+	}
+	if value, ok := flags["probe-path"]; ok {
+		if !strings.HasPrefix(value, "/") {
+			return fmt.Errorf("probe-path must start with /")
+		}
+		probe.Path = value
+	}
+	if value, ok := flags["probe-status"]; ok {
+		code, err := strconv.Atoi(value)
+		if err != nil || code < 100 || code > 599 {
+			return fmt.Errorf("probe-status must be an HTTP status code")
+		}
+		probe.ExpectedStatus = code
+	}
+	if value, ok := flags["probe-body"]; ok {
+		probe.BodyContains = value
+	}
+	if value, ok := flags["probe-timeout"]; ok {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < time.Second || timeout > 2*time.Minute {
+			return fmt.Errorf("probe-timeout must be a duration between 1s and 2m")
+		}
+		probe.TimeoutSeconds = int(timeout / time.Second)
+	}
+	if value, ok := flags["probe-retries"]; ok {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 || retries > 10 {
+			return fmt.Errorf("probe-retries must be between 0 and 10")
+		}
+		// Zero means "use the default", so no retries is stored as -1.
+		if retries == 0 {
+			retries = -1
+		}
+		probe.Retries = retries
+	}
+	return nil
+}
+
+// errHealthCheckFailed is wrapped by runHealthProbe when every attempt
+// failed. Auto-redirect jobs skip the rotation instead of stopping.
+var errHealthCheckFailed = errors.New("health check failed")
+
+// runHealthProbe checks that domain serves the expected response, retrying
+// failed attempts, and returns the error of the last attempt. Cancelling ctx
+// ends the probe early.
+func runHealthProbe(ctx context.Context, probe HealthProbe, domain string) error {
+	if probe.Disabled {
+		return nil
+	}
+
+	var err error
+	for attempt := 0; attempt <= probe.retries(); attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(probeRetryDelay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return fmt.Errorf("health check cancelled: %v", err)
+			}
+		}
+		if err = probeOnce(ctx, probe, domain); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w after %d attempts: %v", errHealthCheckFailed, probe.retries()+1, err)
+}
+
+func probeOnce(ctx context.Context, probe HealthProbe, domain string) error {
+	client := &http.Client{
+		Timeout: probe.timeout(),
+		// The probe checks the new domain itself, not wherever it redirects to.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+domain+probe.path(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != probe.expectedStatus() {
+		return fmt.Errorf("got status %d, expected %d", resp.StatusCode, probe.expectedStatus())
+	}
+	if probe.BodyContains != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, probeBodyLimit))
+		if err != nil {
+			return fmt.Errorf("error reading response body: %v", err)
+		}
+		if !strings.Contains(string(body), probe.BodyContains) {
+			return fmt.Errorf("response body does not contain %q", probe.BodyContains)
+		}
+	}
+	return nil
+}
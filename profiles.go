@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+)
+
+// Every user owns one or more named credential profiles stored under
+// profile:<user_id>:<name>. Commands operate on the active profile, which is
+// kept under activeprofile:<user_id>. Functions taking a profile name also
+// accept "<team>/<name>" references to team profiles, see teams.go.
+const defaultProfileName = "default"
+
+var profileNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+func isValidProfileName(name string) bool {
+	return profileNamePattern.MatchString(name)
+}
+
+func profileKey(userID int64, name string) string {
+	return fmt.Sprintf("profile:%d:%s", userID, name)
+}
+
+func activeProfileKey(userID int64) string {
+	return fmt.Sprintf("activeprofile:%d", userID)
+}
+
+// readTokenRecord loads UserTokens stored under key, decrypting it if needed.
+func readTokenRecord(tx *buntdb.Tx, key string) (UserTokens, error) {
+	var tokens UserTokens
+	val, err := tx.Get(key)
+	if err != nil {
+		return tokens, err
+	}
+	data := []byte(val)
+	if isEncryptedTokenBlob(val) {
+		data, err = decryptTokenBlob(key, val)
+		if err != nil {
+			return tokens, err
+		}
+	}
+	err = json.Unmarshal(data, &tokens)
+	registerTokenSecrets(tokens)
+	return tokens, err
+}
+
+func writeTokenRecord(tx *buntdb.Tx, key string, tokens UserTokens) error {
+	registerTokenSecrets(tokens)
+	jsonTokens, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	sealed, err := encryptTokenBlob(key, jsonTokens)
+	if err != nil {
+		return err
+	}
+	_, _, err = tx.Set(key, sealed, nil)
+	return err
+}
+
+func getActiveProfileName(userID int64) string {
+	name := defaultProfileName
+	db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(activeProfileKey(userID))
+		if err == nil && val != "" {
+			name = val
+		}
+		return nil
+	})
+	return name
+}
+
+func setActiveProfile(userID int64, name string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Get(profileRecordKey(userID, name)); err != nil {
+			if err == buntdb.ErrNotFound {
+				return fmt.Errorf("profile %q does not exist", name)
+			}
+			return err
+		}
+		_, _, err := tx.Set(activeProfileKey(userID), name, nil)
+		return err
+	})
+}
+
+func getProfileTokens(userID int64, name string) (UserTokens, error) {
+	var tokens UserTokens
+	err := db.View(func(tx *buntdb.Tx) error {
+		var err error
+		tokens, err = readTokenRecord(tx, profileRecordKey(userID, name))
+		return err
+	})
+	return tokens, err
+}
+
+func setProfileTokens(userID int64, name string, tokens UserTokens) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		return writeTokenRecord(tx, profileRecordKey(userID, name), tokens)
+	})
+}
+
+func addProfile(userID int64, name string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Get(profileRecordKey(userID, name)); err == nil {
+			return fmt.Errorf("profile %q already exists", name)
+		}
+		return writeTokenRecord(tx, profileRecordKey(userID, name), UserTokens{})
+	})
+}
+
+// deleteProfile removes a personal or team profile. Profiles with running
+// jobs cannot be deleted, since the jobs would fail without their tokens and
+// leave their domains behind.
+func deleteProfile(userID int64, name string) error {
+	jobs, err := getAllAutoRedirectJobs()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if profileRecordKey(job.UserID, job.Profile) == profileRecordKey(userID, name) {
+			return fmt.Errorf("job %s is still running on profile %s, stop it first", job.ID, job.Profile)
+		}
+	}
+
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(profileRecordKey(userID, name))
+		if err == buntdb.ErrNotFound {
+			return fmt.Errorf("profile %q does not exist", name)
+		}
+		return err
+	})
+}
+
+func listProfiles(userID int64) ([]string, error) {
+	var names []string
+	prefix := fmt.Sprintf("profile:%d:", userID)
+	err := db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys(prefix+"*", func(key, value string) bool {
+			names = append(names, strings.TrimPrefix(key, prefix))
+			return true
+		})
+	})
+	return names, err
+}
+
+// migrateLegacyUserTokens moves the single credential set stored under
+// user:<user_id> by older versions into that user's default profile.
+func migrateLegacyUserTokens() (int, error) {
+	migrated := 0
+	err := db.Update(func(tx *buntdb.Tx) error {
+		var legacyKeys []string
+		err := tx.AscendKeys("user:*", func(key, value string) bool {
+			legacyKeys = append(legacyKeys, key)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range legacyKeys {
+			userID, err := strconv.ParseInt(strings.TrimPrefix(key, "user:"), 10, 64)
+			if err != nil {
+				continue
+			}
+			tokens, err := readTokenRecord(tx, key)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %v", key, err)
+			}
+			if err := writeTokenRecord(tx, profileKey(userID, defaultProfileName), tokens); err != nil {
+				return err
+			}
+			if _, err := tx.Delete(key); err != nil {
+				return err
+			}
+			migrated++
+		}
+		return nil
+	})
+	return migrated, err
+}
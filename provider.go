@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RedirectProvider manages the redirect rules that send visitors to the
+// current landing domain. Rules are addressed by the selector shown in
+// /getredirects: their 1-based position or their ID.
+type RedirectProvider interface {
+	Name() string
+	ListRules() ([]RedirectRule, error)
+	SetRedirect(config RedirectConfig) error
+	DeleteRule(selector string) (RedirectRule, error)
+	SetRuleEnabled(selector string, enabled bool) (RedirectRule, error)
+}
+
+const defaultRedirectProvider = "cloudflare"
+
+// newRedirectProvider returns the redirect provider selected in a profile.
+func newRedirectProvider(ctx context.Context, userID int64, profile string, tokens UserTokens) (RedirectProvider, error) {
+	switch tokens.RedirectProviderName() {
+	case "cloudflare":
+		return &CloudflareRedirectProvider{ZoneID: tokens.CloudflareZoneID, Token: tokens.CloudflareToken, ctx: ctx}, nil
+	case "caddy":
+		return newCaddyRedirectProvider(userID, profile)
+	default:
+		return nil, fmt.Errorf("unknown redirect provider %q", tokens.RedirectProvider)
+	}
+}
+
+func isValidRedirectProviderName(name string) bool {
+	return name == "cloudflare" || name == "caddy"
+}
+
+// HostingProvider manages the landing domains served by the hosting platform
+// of a site. Auto-redirect jobs add a freshly generated domain on every
+// rotation and remove the previous one. New domains are named below
+// BaseDomain, and AddDomain wraps errDomainTaken when a name is in use.
+// KeepsGeneratedDomains reports whether a domain added below BaseDomain is
+// served next to the existing ones, which rotations need to switch the
+// redirect only once the new domain works.
+type HostingProvider interface {
+	Name() string
+	ListDomains() ([]string, error)
+	AddDomain(domain string) error
+	RemoveDomain(domain string) error
+	BaseDomain() string
+	KeepsGeneratedDomains() bool
+}
+
+const defaultHostingProvider = "vercel"
+
+// newHostingProvider returns the hosting provider selected in a profile.
+func newHostingProvider(ctx context.Context, tokens UserTokens) (HostingProvider, error) {
+	switch tokens.HostingProviderName() {
+	case "vercel":
+		return &VercelHostingProvider{ProjectID: tokens.VercelProjectID, Token: tokens.VercelToken, ctx: ctx}, nil
+	case "netlify":
+		return &NetlifyHostingProvider{SiteID: tokens.NetlifySiteID, Token: tokens.NetlifyToken, ctx: ctx}, nil
+	default:
+		return nil, fmt.Errorf("unknown hosting provider %q", tokens.HostingProvider)
+	}
+}
+
+func isValidHostingProviderName(name string) bool {
+	return name == "vercel" || name == "netlify"
+}
+
+// isBotRedirectRule reports whether rule is managed by the bot. Versions
+// before scoped redirects wrote a single untagged "true" rule described as
+// "Redirect to <url>"; it is treated as the unscoped bot rule, and gets the
+// ref and tag the next time it is updated.
+func isBotRedirectRule(rule RedirectRule) bool {
+	if strings.HasPrefix(rule.Ref, botRedirectRuleRef) || strings.HasPrefix(rule.Description, botRedirectRuleTag) {
+		return true
+	}
+	return rule.Expression == "true" && strings.HasPrefix(rule.Description, legacyBotRedirectDescription)
+}
+
+// findRedirectRule resolves a rule by its 1-based position in the ruleset, as
+// shown by /getredirects, or by its rule ID.
+func findRedirectRule(ruleset RedirectRuleset, selector string) (RedirectRule, error) {
+	if index, err := strconv.Atoi(selector); err == nil {
+		if index < 1 || index > len(ruleset.Rules) {
+			return RedirectRule{}, fmt.Errorf("there is no redirect rule #%d", index)
+		}
+		return ruleset.Rules[index-1], nil
+	}
+	for _, rule := range ruleset.Rules {
+		if rule.ID == selector {
+			return rule, nil
+		}
+	}
+	return RedirectRule{}, fmt.Errorf("there is no redirect rule with ID %s", selector)
+}
+
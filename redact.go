@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// minSecretLength keeps short values, which could match ordinary words in a
+// log line, out of the redaction list.
+const minSecretLength = 8
+
+var (
+	secretsLock sync.RWMutex
+	secrets     = make(map[string]bool)
+
+	// telegramTokenPattern matches bot tokens that were not registered, e.g.
+	// in URLs logged by the Telegram client.
+	telegramTokenPattern = regexp.MustCompile(`\d{6,}:[A-Za-z0-9_-]{30,}`)
+)
+
+// maskSecret shows only the last 4 characters of a secret.
+func maskSecret(secret string) string {
+	if secret == "" {
+		return "(not set)"
+	}
+	if len(secret) <= 4 {
+		return "••••"
+	}
+	return "••••" + secret[len(secret)-4:]
+}
+
+// registerSecret adds a value that must never appear in logs.
+func registerSecret(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+	secretsLock.Lock()
+	secrets[secret] = true
+	secretsLock.Unlock()
+}
+
+// registerTokenSecrets registers the API tokens of a profile.
+func registerTokenSecrets(tokens UserTokens) {
+	registerSecret(tokens.VercelToken)
+	registerSecret(tokens.CloudflareToken)
+	registerSecret(tokens.NetlifyToken)
+}
+
+// registerEnvSecrets registers the secrets the bot is configured with.
+// SECRET_CODE is no longer used but may still be set in old deployments.
+func registerEnvSecrets() {
+	for _, name := range []string{"TELEGRAM_TOKEN", "TOKEN_ENCRYPTION_KEY", "WEBHOOK_SECRET", "SECRET_CODE"} {
+		registerSecret(os.Getenv(name))
+	}
+}
+
+// redactSecrets masks every registered secret and Telegram bot token in text.
+func redactSecrets(text string) string {
+	secretsLock.RLock()
+	known := make([]string, 0, len(secrets))
+	for secret := range secrets {
+		if strings.Contains(text, secret) {
+			known = append(known, secret)
+		}
+	}
+	secretsLock.RUnlock()
+
+	// Longer secrets first, in case one contains another.
+	sort.Slice(known, func(i, j int) bool { return len(known[i]) > len(known[j]) })
+	for _, secret := range known {
+		text = strings.ReplaceAll(text, secret, maskSecret(secret))
+	}
+	return telegramTokenPattern.ReplaceAllStringFunc(text, maskSecret)
+}
+
+// redactingWriter redacts secrets from everything written through the
+// standard logger, including log lines of libraries.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (rw redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, redactSecrets(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// isSecretCommand reports whether the arguments of a command contain API
+// tokens.
+func isSecretCommand(command string) bool {
+	switch command {
+	case "setverceltoken", "setcloudflaretoken", "setnetlifytoken", "settokens":
+		return true
+	default:
+		return false
+	}
+}
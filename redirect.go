@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RedirectConfig describes a redirect rule managed by the bot. An empty Host
+// matches all traffic of the zone; PathPrefix further limits a host-scoped
+// rule to requests whose path starts with it. The zero value redirects with
+// 301 and preserves the query string.
+type RedirectConfig struct {
+	TargetURL       string `json:"target_url"`
+	Host            string `json:"host,omitempty"`
+	PathPrefix      string `json:"path_prefix,omitempty"`
+	StatusCode      int    `json:"status_code,omitempty"`
+	DropQueryString bool   `json:"drop_query_string,omitempty"`
+}
+
+const defaultRedirectStatusCode = 301
+
+func isValidRedirectStatusCode(code int) bool {
+	switch code {
+	case 301, 302, 307, 308:
+		return true
+	default:
+		return false
+	}
+}
+
+func (config RedirectConfig) EffectiveStatusCode() int {
+	if config.StatusCode == 0 {
+		return defaultRedirectStatusCode
+	}
+	return config.StatusCode
+}
+
+// applyRedirectFlags reads the --status and --query options shared by
+// /setredirect and /startautoredirect into config.
+func applyRedirectFlags(flags map[string]string, config *RedirectConfig) error {
+	if value, ok := flags["status"]; ok {
+		code, err := strconv.Atoi(value)
+		if err != nil || !isValidRedirectStatusCode(code) {
+			return fmt.Errorf("status must be one of 301, 302, 307 or 308")
+		}
+		config.StatusCode = code
+	}
+	if value, ok := flags["query"]; ok {
+		switch value {
+		case "keep":
+			config.DropQueryString = false
+		case "drop":
+			config.DropQueryString = true
+		default:
+			return fmt.Errorf("query must be keep or drop")
+		}
+	}
+	return nil
+}
+
+func formatQueryStringHandling(preserve bool) string {
+	if preserve {
+		return "kept"
+	}
+	return "dropped"
+}
+
+// redirectUnsafeCharacters may not appear in redirect targets and path
+// prefixes. Quotes, backslashes and whitespace would break out of the
+// wirefilter string literal or split a Caddyfile token, and Caddy expands
+// {...} as a placeholder, e.g. {env.NAME} to an environment variable.
+const redirectUnsafeCharacters = "{}\"`\\ \t\r\n"
+
+var hostnamePattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// parseRedirectSource parses "host" or "host/path/prefix" into the scope of
+// config.
+func parseRedirectSource(source string, config *RedirectConfig) error {
+	source = strings.TrimPrefix(strings.TrimPrefix(source, "https://"), "http://")
+	host, path := source, ""
+	if i := strings.Index(source, "/"); i >= 0 {
+		host, path = source[:i], source[i:]
+	}
+	config.Host = strings.ToLower(host)
+	config.PathPrefix = strings.TrimRight(path, "/")
+	return validateRedirectScope(*config)
+}
+
+func validateRedirectScope(config RedirectConfig) error {
+	if config.Host == "" {
+		if config.PathPrefix != "" {
+			return fmt.Errorf("a path prefix requires a source hostname")
+		}
+		return nil
+	}
+	if len(config.Host) > 253 || !hostnamePattern.MatchString(config.Host) {
+		return fmt.Errorf("invalid source hostname %q", config.Host)
+	}
+	if config.PathPrefix != "" {
+		if !strings.HasPrefix(config.PathPrefix, "/") || len(config.PathPrefix) > 1024 {
+			return fmt.Errorf("invalid path prefix %q", config.PathPrefix)
+		}
+		if strings.ContainsAny(config.PathPrefix, redirectUnsafeCharacters) {
+			return fmt.Errorf("path prefix %q contains characters that are not allowed", config.PathPrefix)
+		}
+	}
+	return nil
+}
+
+// validateRedirectTarget checks the target URL of config. Unsafe characters
+// are rejected instead of escaped, like in path prefixes.
+func validateRedirectTarget(config RedirectConfig) error {
+	if strings.ContainsAny(config.TargetURL, redirectUnsafeCharacters) {
+		return fmt.Errorf("target URL %q contains characters that are not allowed", config.TargetURL)
+	}
+	return nil
+}
+
+// Expression builds the Cloudflare wirefilter expression matching the scope.
+func (config RedirectConfig) Expression() string {
+	if config.Host == "" {
+		return "true"
+	}
+	expression := fmt.Sprintf("http.host eq %q", config.Host)
+	if config.PathPrefix != "" {
+		expression = fmt.Sprintf("(%s and starts_with(http.request.uri.path, %q))", expression, config.PathPrefix)
+	}
+	return expression
+}
+
+// isShadowedBy reports whether a rule with expression matches every request
+// matched by the scope of config: all traffic, the whole host or a shorter
+// path prefix on it.
+func (config RedirectConfig) isShadowedBy(expression string) bool {
+	if config.Host == "" {
+		return false
+	}
+	if expression == "true" {
+		return true
+	}
+	broader := RedirectConfig{Host: config.Host}
+	for i := 0; i < len(config.PathPrefix); i++ {
+		broader.PathPrefix = config.PathPrefix[:i]
+		if broader.Expression() == expression {
+			return true
+		}
+	}
+	return false
+}
+
+// Source is the human readable form of the scope.
+func (config RedirectConfig) Source() string {
+	if config.Host == "" {
+		return "all traffic"
+	}
+	return config.Host + config.PathPrefix
+}
+
+// Ref identifies the bot-owned rule for this scope. The unscoped rule keeps
+// the plain botRedirectRuleRef; the untagged rule of older versions has no
+// ref and is matched by isBotRedirectRule instead.
+func (config RedirectConfig) Ref() string {
+	if config.Host == "" {
+		return botRedirectRuleRef
+	}
+	sum := sha1.Sum([]byte(config.Host + config.PathPrefix))
+	return botRedirectRuleRef + "_" + hex.EncodeToString(sum[:])[:12]
+}
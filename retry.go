@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how API requests to Vercel, Netlify and Cloudflare are
+// retried after network errors, 5xx responses and rate limiting. The delay
+// before attempt n is BaseDelay*2^(n-1), capped at MaxDelay, with up to Jitter
+// of it randomized. A 429 response waits for its Retry-After instead, but at
+// most MaxRetryAfter. Every attempt times out after Timeout.
+type RetryPolicy struct {
+	MaxAttempts   int
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	Jitter        float64
+	Timeout       time.Duration
+	MaxRetryAfter time.Duration
+}
+
+// retryPolicy is used by auto-redirect jobs, which run in the background and
+// can wait out an outage or a rate limit.
+var retryPolicy = RetryPolicy{
+	MaxAttempts:   5,
+	BaseDelay:     time.Second,
+	MaxDelay:      time.Minute,
+	Jitter:        0.5,
+	Timeout:       30 * time.Second,
+	MaxRetryAfter: 5 * time.Minute,
+}
+
+// commandRetryPolicy is used while a command is handled. Commands are handled
+// one at a time, so a slow or rate limited API must not hold up every other
+// user for long.
+var commandRetryPolicy = RetryPolicy{
+	MaxAttempts:   2,
+	BaseDelay:     time.Second,
+	MaxDelay:      2 * time.Second,
+	Jitter:        0.5,
+	Timeout:       10 * time.Second,
+	MaxRetryAfter: 2 * time.Second,
+}
+
+type retryPolicyKey struct{}
+
+// withRetryPolicy returns a context that makes sendWithRetry use policy for
+// requests created with it.
+func withRetryPolicy(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, policy)
+}
+
+func retryPolicyFromContext(ctx context.Context) RetryPolicy {
+	if policy, ok := ctx.Value(retryPolicyKey{}).(RetryPolicy); ok {
+		return policy
+	}
+	return retryPolicy
+}
+
+// loadRetryPolicy overrides the policy of auto-redirect jobs from
+// RETRY_MAX_ATTEMPTS, RETRY_BASE_DELAY and RETRY_MAX_DELAY.
+func loadRetryPolicy() error {
+	if value := os.Getenv("RETRY_MAX_ATTEMPTS"); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts < 1 {
+			return fmt.Errorf("RETRY_MAX_ATTEMPTS must be a positive integer")
+		}
+		retryPolicy.MaxAttempts = attempts
+	}
+	if value := os.Getenv("RETRY_BASE_DELAY"); value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay <= 0 {
+			return fmt.Errorf("RETRY_BASE_DELAY must be a positive duration such as 1s")
+		}
+		retryPolicy.BaseDelay = delay
+	}
+	if value := os.Getenv("RETRY_MAX_DELAY"); value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay < retryPolicy.BaseDelay {
+			return fmt.Errorf("RETRY_MAX_DELAY must be a duration of at least RETRY_BASE_DELAY")
+		}
+		retryPolicy.MaxDelay = delay
+	}
+	return nil
+}
+
+func (policy RetryPolicy) backoff(attempt int) time.Duration {
+	delay := policy.BaseDelay << (attempt - 1)
+	if delay > policy.MaxDelay || delay <= 0 {
+		delay = policy.MaxDelay
+	}
+	jitter := time.Duration(rand.Float64() * policy.Jitter * float64(delay))
+	return delay - jitter
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP
+// date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date), true
+	}
+	return 0, false
+}
+
+// sendWithRetry sends req according to the retry policy of its context, or
+// retryPolicy if it has none, and returns the status code and body of the
+// last response. Cancelling the context also ends the wait between attempts.
+// Requests with a body must have been created by http.NewRequestWithContext
+// so the body can be replayed.
+func sendWithRetry(req *http.Request) (int, []byte, error) {
+	ctx := req.Context()
+	policy := retryPolicyFromContext(ctx)
+	client := &http.Client{Timeout: policy.Timeout}
+
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		attemptReq := req.Clone(ctx)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return 0, nil, fmt.Errorf("error preparing request body: %v", err)
+			}
+			attemptReq.Body = body
+		}
+
+		var statusCode int
+		var body []byte
+		var retryAfter time.Duration
+		var hasRetryAfter bool
+
+		resp, err := client.Do(attemptReq)
+		if err == nil {
+			statusCode = resp.StatusCode
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil && !isRetryableStatus(statusCode) {
+				return statusCode, body, nil
+			}
+			if statusCode == http.StatusTooManyRequests {
+				retryAfter, hasRetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			}
+		}
+
+		if err != nil {
+			lastErr = err
+		} else {
+			lastErr = fmt.Errorf("status code %d: %s", statusCode, string(body))
+		}
+		if attempt >= policy.MaxAttempts {
+			if err != nil {
+				return 0, nil, fmt.Errorf("%s %s failed after %d attempts: %v", req.Method, req.URL.Host, attempt, lastErr)
+			}
+			// The caller reports the final response like any other failure.
+			return statusCode, body, nil
+		}
+
+		delay := policy.backoff(attempt)
+		if hasRetryAfter {
+			delay = retryAfter
+			if delay > policy.MaxRetryAfter {
+				delay = policy.MaxRetryAfter
+			}
+		}
+		log.Printf("[INFO] %s %s attempt %d/%d failed (%v), retrying in %s", req.Method, req.URL.Host, attempt, policy.MaxAttempts, lastErr, delay.Round(time.Millisecond))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, nil, fmt.Errorf("%s %s cancelled after %d attempts: %v", req.Method, req.URL.Host, attempt, lastErr)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+)
+
+// Role is a user's access level. Every role includes the permissions of the
+// roles below it. Roles are stored under role:<user_id>; users without one
+// can only use the commands open to roleNone.
+type Role int
+
+const (
+	roleNone Role = iota
+	roleViewer
+	roleOperator
+	roleAdmin
+	roleOwner
+)
+
+var roleNames = map[Role]string{
+	roleNone:     "none",
+	roleViewer:   "viewer",
+	roleOperator: "operator",
+	roleAdmin:    "admin",
+	roleOwner:    "owner",
+}
+
+func (role Role) String() string {
+	return roleNames[role]
+}
+
+func parseRole(name string) (Role, bool) {
+	for role, roleName := range roleNames {
+		if role != roleNone && roleName == strings.ToLower(name) {
+			return role, true
+		}
+	}
+	return roleNone, false
+}
+
+// commandRoles is the minimum role needed for each command. Commands that are
+// not listed require roleOperator. /profile checks the role of each action
+// itself, since viewers may only list and switch profiles.
+var commandRoles = map[string]Role{
+	"start":        roleNone,
+	"help":         roleNone,
+	"guide":        roleNone,
+	"whoami":       roleNone,
+	"getdomains":   roleViewer,
+	"getredirects": roleViewer,
+	"jobs":         roleViewer,
+	"profile":      roleViewer,
+	"admin":        roleAdmin,
+	"grant":        roleAdmin,
+	"revoke":       roleAdmin,
+	"roles":        roleAdmin,
+	"audit":        roleAdmin,
+}
+
+func requiredRole(command string) Role {
+	if role, ok := commandRoles[command]; ok {
+		return role
+	}
+	return roleOperator
+}
+
+func roleKey(userID int64) string {
+	return fmt.Sprintf("role:%d", userID)
+}
+
+func getUserRole(userID int64) Role {
+	role := roleNone
+	db.View(func(tx *buntdb.Tx) error {
+		name, err := tx.Get(roleKey(userID))
+		if err == nil {
+			role, _ = parseRole(name)
+		}
+		return nil
+	})
+	return role
+}
+
+func setUserRole(userID int64, role Role) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(roleKey(userID), role.String(), nil)
+		return err
+	})
+}
+
+// getAllUserRoles returns every user with a role, highest role first.
+func getAllUserRoles() ([]int64, map[int64]Role, error) {
+	roles := make(map[int64]Role)
+	var userIDs []int64
+	err := db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys("role:*", func(key, value string) bool {
+			userID, err := strconv.ParseInt(strings.TrimPrefix(key, "role:"), 10, 64)
+			if role, ok := parseRole(value); err == nil && ok {
+				roles[userID] = role
+				userIDs = append(userIDs, userID)
+			}
+			return true
+		})
+	})
+	sort.Slice(userIDs, func(i, j int) bool {
+		if roles[userIDs[i]] != roles[userIDs[j]] {
+			return roles[userIDs[i]] > roles[userIDs[j]]
+		}
+		return userIDs[i] < userIDs[j]
+	})
+	return userIDs, roles, err
+}
+
+// canManageRole reports whether a user with role actor may grant target to
+// someone, or change the role of someone who has target. Owners manage every
+// role, admins only the roles below their own.
+func canManageRole(actor, target Role) bool {
+	return actor == roleOwner || (actor >= roleAdmin && target < actor)
+}
+
+// grantRole gives userID role on behalf of actorID. Nobody can change their
+// own role, so the bot always keeps at least one owner.
+func grantRole(actorID, userID int64, role Role) error {
+	if actorID == userID {
+		return fmt.Errorf("you cannot change your own role")
+	}
+	actor := getUserRole(actorID)
+	if !canManageRole(actor, role) {
+		return fmt.Errorf("your role %s cannot grant the %s role", actor, role)
+	}
+	if current := getUserRole(userID); !canManageRole(actor, current) {
+		return fmt.Errorf("your role %s cannot change the role of a %s", actor, current)
+	}
+	return setUserRole(userID, role)
+}
+
+// revokeRole removes the role of userID on behalf of actorID.
+func revokeRole(actorID, userID int64) error {
+	if actorID == userID {
+		return fmt.Errorf("you cannot revoke your own role")
+	}
+	actor := getUserRole(actorID)
+	current := getUserRole(userID)
+	if current == roleNone {
+		return fmt.Errorf("user %d has no role", userID)
+	}
+	if !canManageRole(actor, current) {
+		return fmt.Errorf("your role %s cannot revoke the role of a %s", actor, current)
+	}
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(roleKey(userID))
+		return err
+	})
+}
+
+// bootstrapRoles makes the user in OWNER_USER_ID an owner on every start and
+// turns users whitelisted by older versions of the bot into operators, which
+// matches the access they had before roles existed.
+func bootstrapRoles() error {
+	if value := os.Getenv("OWNER_USER_ID"); value != "" {
+		ownerID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("OWNER_USER_ID must be a numeric Telegram user ID")
+		}
+		if err := setUserRole(ownerID, roleOwner); err != nil {
+			return err
+		}
+	}
+
+	err := db.Update(func(tx *buntdb.Tx) error {
+		var whitelisted []string
+		err := tx.AscendKeys("whitelist:*", func(key, value string) bool {
+			whitelisted = append(whitelisted, key)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range whitelisted {
+			userID := strings.TrimPrefix(key, "whitelist:")
+			if _, err := tx.Get("role:" + userID); err == buntdb.ErrNotFound {
+				if _, _, err := tx.Set("role:"+userID, roleOperator.String(), nil); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	userIDs, roles, err := getAllUserRoles()
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		if roles[userID] == roleOwner {
+			return nil
+		}
+	}
+	return fmt.Errorf("no owner is configured, set OWNER_USER_ID to your Telegram user ID")
+}
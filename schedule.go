@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule decides when an auto-redirect job rotates next. Jobs store the
+// text they were started with in AutoRedirectJob.Schedule and parse it again
+// when they are resumed. Supported forms:
+//
+//	30                     every 30 minutes
+//	every 45m              every 45 minutes (any Go duration of at least 1m)
+//	45-75, every 45m-75m   a random interval between 45 and 75 minutes,
+//	                       drawn again for every rotation
+//	every 30m between 08:00-22:00 Europe/Berlin otherwise 1h
+//	                       every 30 minutes inside the daily window and every
+//	                       hour outside it; without "otherwise" the job does
+//	                       not rotate outside the window. Both intervals may
+//	                       be random ranges too
+//	cron */15 8-21 * * 1-5 Europe/Berlin
+//	                       a five-field cron expression (minute hour
+//	                       day-of-month month day-of-week) with an optional
+//	                       time zone
+type Schedule interface {
+	Next(after time.Time) time.Time
+	String() string
+}
+
+const (
+	minScheduleInterval = time.Minute
+	// maxCronSearch bounds the search for the next matching cron time so an
+	// expression such as "0 0 30 2 *" is rejected instead of looping forever.
+	maxCronSearch = 5 * 366 * 24 * time.Hour
+)
+
+// parseSchedule parses the schedule part of /startautoredirect.
+func parseSchedule(spec string) (Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing schedule")
+	}
+
+	var schedule Schedule
+	var err error
+	switch strings.ToLower(fields[0]) {
+	case "every":
+		schedule, err = parseWindowSchedule(fields[1:])
+	case "cron":
+		schedule, err = parseCronSchedule(fields[1:])
+	default:
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("unknown schedule %q, start it with a number of minutes, \"every\" or \"cron\"", spec)
+		}
+		schedule, err = parseIntervalSchedule(fields[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if schedule.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("the schedule %s never runs", schedule)
+	}
+	return schedule, nil
+}
+
+// plannedRuns returns the next count rotation times of schedule after start.
+func plannedRuns(schedule Schedule, start time.Time, count int) []time.Time {
+	var runs []time.Time
+	next := start
+	for i := 0; i < count; i++ {
+		next = schedule.Next(next)
+		if next.IsZero() {
+			break
+		}
+		runs = append(runs, next)
+	}
+	return runs
+}
+
+func formatPlannedRuns(runs []time.Time) string {
+	var text strings.Builder
+	for _, run := range runs {
+		text.WriteString("• " + run.Format("Mon 2006-01-02 15:04 MST") + "\n")
+	}
+	return text.String()
+}
+
+// intervalSchedule rotates every `every`, or after a random interval between
+// every and maxEvery when maxEvery is set.
+type intervalSchedule struct {
+	every    time.Duration
+	maxEvery time.Duration
+}
+
+// parseIntervalSchedule accepts a plain number of minutes, a Go duration or a
+// range of either such as 45-75 or 45m-1h15m.
+func parseIntervalSchedule(value string) (intervalSchedule, error) {
+	value = strings.NewReplacer("–", "-", "—", "-").Replace(value)
+	if minText, maxText, isRange := strings.Cut(value, "-"); isRange {
+		min, err := parseIntervalSchedule(minText)
+		if err != nil {
+			return intervalSchedule{}, err
+		}
+		max, err := parseIntervalSchedule(maxText)
+		if err != nil {
+			return intervalSchedule{}, err
+		}
+		if max.every <= min.every {
+			return intervalSchedule{}, fmt.Errorf("the upper end of the interval range %q must be larger than the lower end", value)
+		}
+		return intervalSchedule{every: min.every, maxEvery: max.every}, nil
+	}
+	if minutes, err := strconv.Atoi(value); err == nil {
+		if minutes <= 0 {
+			return intervalSchedule{}, fmt.Errorf("the refresh time must be a positive number of minutes")
+		}
+		return intervalSchedule{every: time.Duration(minutes) * time.Minute}, nil
+	}
+	every, err := time.ParseDuration(value)
+	if err != nil {
+		return intervalSchedule{}, fmt.Errorf("invalid interval %q, use minutes or a duration such as 30m or 2h", value)
+	}
+	if every < minScheduleInterval {
+		return intervalSchedule{}, fmt.Errorf("the interval must be at least %s", minScheduleInterval)
+	}
+	return intervalSchedule{every: every}, nil
+}
+
+// interval returns the time until the next rotation, drawn at random for
+// interval ranges.
+func (s intervalSchedule) interval() time.Duration {
+	if s.maxEvery == 0 {
+		return s.every
+	}
+	jitter := time.Duration(rand.Int63n(int64(s.maxEvery-s.every) + 1))
+	return (s.every + jitter).Round(time.Second)
+}
+
+func (s intervalSchedule) Next(after time.Time) time.Time {
+	return after.Add(s.interval()).UTC()
+}
+
+func (s intervalSchedule) String() string {
+	if s.maxEvery == 0 {
+		return "every " + formatScheduleDuration(s.every)
+	}
+	return fmt.Sprintf("every %s-%s (random)", formatScheduleDuration(s.every), formatScheduleDuration(s.maxEvery))
+}
+
+// windowSchedule rotates every `every` inside a daily time window and every
+// `otherwise` outside it. A zero otherwise pauses rotations outside the
+// window. Windows may wrap around midnight, e.g. 22:00-06:00.
+type windowSchedule struct {
+	every     intervalSchedule
+	start     int // minutes after midnight
+	end       int
+	location  *time.Location
+	otherwise intervalSchedule
+}
+
+// parseWindowSchedule parses the fields following "every".
+func parseWindowSchedule(fields []string) (Schedule, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing interval after \"every\"")
+	}
+	interval, err := parseIntervalSchedule(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 1 {
+		return interval, nil
+	}
+	if strings.ToLower(fields[1]) != "between" || len(fields) < 3 {
+		return nil, fmt.Errorf("expected \"between HH:MM-HH:MM\" after the interval")
+	}
+
+	schedule := windowSchedule{every: interval, location: time.UTC}
+	startText, endText, found := strings.Cut(strings.NewReplacer("–", "-", "—", "-").Replace(fields[2]), "-")
+	if !found {
+		return nil, fmt.Errorf("invalid time window %q, use HH:MM-HH:MM", fields[2])
+	}
+	if schedule.start, err = parseClockTime(startText); err != nil {
+		return nil, err
+	}
+	if schedule.end, err = parseClockTime(endText); err != nil {
+		return nil, err
+	}
+	if schedule.start == schedule.end {
+		return nil, fmt.Errorf("the time window must not be empty")
+	}
+
+	rest := fields[3:]
+	if len(rest) > 0 && strings.ToLower(rest[0]) != "otherwise" {
+		if schedule.location, err = time.LoadLocation(rest[0]); err != nil {
+			return nil, fmt.Errorf("unknown time zone %q", rest[0])
+		}
+		rest = rest[1:]
+	}
+	if len(rest) > 0 {
+		if strings.ToLower(rest[0]) != "otherwise" {
+			return nil, fmt.Errorf("unexpected %q in schedule", rest[0])
+		}
+		rest = rest[1:]
+		if len(rest) > 0 && strings.ToLower(rest[0]) == "every" {
+			rest = rest[1:]
+		}
+		if len(rest) == 1 && strings.ToLower(rest[0]) == "hourly" {
+			schedule.otherwise = intervalSchedule{every: time.Hour}
+		} else if len(rest) == 1 {
+			if schedule.otherwise, err = parseIntervalSchedule(rest[0]); err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, fmt.Errorf("expected one interval after \"otherwise\"")
+		}
+	}
+	return schedule, nil
+}
+
+func parseClockTime(value string) (int, error) {
+	clock, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		if value == "24:00" {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("invalid time %q, use HH:MM", value)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+func (s windowSchedule) inWindow(t time.Time) bool {
+	local := t.In(s.location)
+	minute := local.Hour()*60 + local.Minute()
+	if s.start < s.end {
+		return minute >= s.start && minute < s.end
+	}
+	return minute >= s.start || minute < s.end
+}
+
+// nextWindowStart returns the first start of the window after t.
+func (s windowSchedule) nextWindowStart(t time.Time) time.Time {
+	local := t.In(s.location)
+	start := time.Date(local.Year(), local.Month(), local.Day(), s.start/60, s.start%60, 0, 0, s.location)
+	if !start.After(t) {
+		start = time.Date(local.Year(), local.Month(), local.Day()+1, s.start/60, s.start%60, 0, 0, s.location)
+	}
+	return start
+}
+
+func (s windowSchedule) Next(after time.Time) time.Time {
+	if !s.inWindow(after) {
+		windowStart := s.nextWindowStart(after)
+		if s.otherwise.every == 0 {
+			return windowStart
+		}
+		if next := after.Add(s.otherwise.interval()); next.Before(windowStart) {
+			return next.In(s.location)
+		}
+		return windowStart
+	}
+	next := after.Add(s.every.interval())
+	if s.otherwise.every == 0 && !s.inWindow(next) {
+		return s.nextWindowStart(next)
+	}
+	return next.In(s.location)
+}
+
+func (s windowSchedule) String() string {
+	text := fmt.Sprintf("%s between %02d:%02d-%02d:%02d %s", s.every, s.start/60, s.start%60, s.end/60, s.end%60, s.location)
+	if s.otherwise.every == 0 {
+		return text + ", paused otherwise"
+	}
+	return text + ", otherwise " + s.otherwise.String()
+}
+
+// cronSchedule is a standard five-field cron expression. Fields are stored
+// as bit sets of the values they match.
+type cronSchedule struct {
+	expression string
+	minute     uint64
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64
+	// Like cron, when both day fields are restricted a day matching either
+	// of them matches.
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+	location      *time.Location
+}
+
+// parseCronSchedule parses the fields following "cron".
+func parseCronSchedule(fields []string) (Schedule, error) {
+	if len(fields) != 5 && len(fields) != 6 {
+		return nil, fmt.Errorf("a cron expression needs 5 fields (minute hour day-of-month month day-of-week) and an optional time zone")
+	}
+
+	schedule := cronSchedule{expression: strings.Join(fields[:5], " "), location: time.UTC}
+	if len(fields) == 6 {
+		location, err := time.LoadLocation(fields[5])
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone %q", fields[5])
+		}
+		schedule.location = location
+	}
+
+	var err error
+	if schedule.minute, err = parseCronField(fields[0], 0, 59, "minute"); err != nil {
+		return nil, err
+	}
+	if schedule.hour, err = parseCronField(fields[1], 0, 23, "hour"); err != nil {
+		return nil, err
+	}
+	if schedule.dayOfMonth, err = parseCronField(fields[2], 1, 31, "day-of-month"); err != nil {
+		return nil, err
+	}
+	if schedule.month, err = parseCronField(fields[3], 1, 12, "month"); err != nil {
+		return nil, err
+	}
+	if schedule.dayOfWeek, err = parseCronField(fields[4], 0, 7, "day-of-week"); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 mean Sunday.
+	if schedule.dayOfWeek&(1<<7) != 0 {
+		schedule.dayOfWeek |= 1
+	}
+	schedule.anyDayOfMonth = strings.HasPrefix(fields[2], "*")
+	schedule.anyDayOfWeek = strings.HasPrefix(fields[4], "*")
+	return schedule, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges (a-b) and
+// steps (*/n, a-b/n) between min and max.
+func parseCronField(field string, min, max int, name string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeText, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepText)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q in cron %s field", stepText, name)
+			}
+		}
+
+		low, high := min, max
+		if rangeText != "*" {
+			lowText, highText, isRange := strings.Cut(rangeText, "-")
+			var err error
+			if low, err = strconv.Atoi(lowText); err != nil {
+				return 0, fmt.Errorf("invalid value %q in cron %s field", part, name)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(highText); err != nil {
+					return 0, fmt.Errorf("invalid value %q in cron %s field", part, name)
+				}
+			} else if hasStep {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("cron %s field must be between %d and %d", name, min, max)
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func (s cronSchedule) matchesDay(t time.Time) bool {
+	dayOfMonth := s.dayOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := s.dayOfWeek&(1<<uint(t.Weekday())) != 0
+	if s.anyDayOfMonth || s.anyDayOfWeek {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
+
+// Next returns the first matching minute after `after`, or the zero time if
+// there is none within maxCronSearch.
+func (s cronSchedule) Next(after time.Time) time.Time {
+	t := after.In(s.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxCronSearch)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.location)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.location)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.location)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s cronSchedule) String() string {
+	return fmt.Sprintf("cron %s %s", s.expression, s.location)
+}
+
+// formatScheduleDuration prints whole-minute durations as e.g. "30m" or
+// "1h30m" rather than "1h30m0s".
+func formatScheduleDuration(d time.Duration) string {
+	text := d.String()
+	if strings.HasSuffix(text, "m0s") {
+		text = strings.TrimSuffix(text, "0s")
+	}
+	if strings.HasSuffix(text, "h0m") {
+		text = strings.TrimSuffix(text, "0m")
+	}
+	return text
+}
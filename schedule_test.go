@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"", "missing schedule"},
+		{"0", "positive number of minutes"},
+		{"30s", "at least 1m0s"},
+		{"soon", "invalid interval"},
+		{"75-45", "must be larger"},
+		{"30 minutes", "unknown schedule"},
+		{"every", "missing interval"},
+		{"every 30m from 08:00-22:00", "between HH:MM-HH:MM"},
+		{"every 30m between", "between HH:MM-HH:MM"},
+		{"every 30m between 08:00", "invalid time window"},
+		{"every 30m between 08:00-08:00", "must not be empty"},
+		{"every 30m between 08:00-25:00", "invalid time"},
+		{"every 30m between 08:00-22:00 Mars/Olympus", "unknown time zone"},
+		{"every 30m between 08:00-22:00 UTC later", "unexpected"},
+		{"every 30m between 08:00-22:00 UTC otherwise", "one interval"},
+		{"every 30m between 08:00-22:00 UTC otherwise 10s", "at least 1m0s"},
+		{"cron * * * *", "needs 5 fields"},
+		{"cron 60 * * * *", "minute field"},
+		{"cron * 24 * * *", "hour field"},
+		{"cron * * 0 * *", "day-of-month field"},
+		{"cron * * * 13 *", "month field"},
+		{"cron * * * * 8", "day-of-week field"},
+		{"cron 5-1 * * * *", "minute field"},
+		{"cron */0 * * * *", "invalid step"},
+		{"cron a * * * *", "invalid value"},
+		{"cron * * * * * Mars/Olympus", "unknown time zone"},
+		{"cron 0 0 30 2 *", "never runs"},
+		{"cron 0 0 31 4,6,9,11 *", "never runs"},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			schedule, err := parseSchedule(test.spec)
+			if err == nil {
+				t.Fatalf("parseSchedule(%q) = %s, want an error", test.spec, schedule)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("parseSchedule(%q) error = %q, want it to contain %q", test.spec, err, test.want)
+			}
+		})
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name  string
+		spec  string
+		after time.Time
+		want  time.Time
+	}{
+		{"minutes", "30", utc(2024, 1, 1, 23, 50), utc(2024, 1, 2, 0, 20)},
+		{"duration", "every 2h", utc(2024, 1, 1, 23, 0), utc(2024, 1, 2, 1, 0)},
+
+		{"window inside", "every 30m between 08:00-22:00", utc(2024, 1, 1, 12, 0), utc(2024, 1, 1, 12, 30)},
+		{"window before start", "every 30m between 08:00-22:00", utc(2024, 1, 1, 3, 0), utc(2024, 1, 1, 8, 0)},
+		{"window paused after end", "every 30m between 08:00-22:00", utc(2024, 1, 1, 21, 50), utc(2024, 1, 2, 8, 0)},
+		{"window otherwise", "every 30m between 08:00-22:00 UTC otherwise 2h", utc(2024, 1, 1, 3, 0), utc(2024, 1, 1, 5, 0)},
+		{"window otherwise until start", "every 30m between 08:00-22:00 UTC otherwise 2h", utc(2024, 1, 1, 7, 0), utc(2024, 1, 1, 8, 0)},
+		{"window otherwise overruns end", "every 30m between 08:00-22:00 UTC otherwise hourly", utc(2024, 1, 1, 21, 50), utc(2024, 1, 1, 22, 20)},
+		{"wrapping window across midnight", "every 30m between 22:00-06:00", utc(2024, 1, 1, 23, 50), utc(2024, 1, 2, 0, 20)},
+		{"wrapping window after end", "every 30m between 22:00-06:00", utc(2024, 1, 2, 5, 50), utc(2024, 1, 2, 22, 0)},
+		{"wrapping window outside", "every 30m between 22:00-06:00", utc(2024, 1, 2, 12, 0), utc(2024, 1, 2, 22, 0)},
+		// Berlin switches to summer time at 02:00 on 2024-03-31 and back at
+		// 03:00 on 2024-10-27.
+		{"window start after spring forward", "every 1h between 08:00-20:00 Europe/Berlin", time.Date(2024, 3, 30, 19, 30, 0, 0, berlin), time.Date(2024, 3, 31, 8, 0, 0, 0, berlin)},
+		{"window start after fall back", "every 1h between 08:00-20:00 Europe/Berlin", time.Date(2024, 10, 26, 19, 30, 0, 0, berlin), time.Date(2024, 10, 27, 8, 0, 0, 0, berlin)},
+
+		{"cron step", "cron */15 * * * *", utc(2024, 1, 1, 10, 7), utc(2024, 1, 1, 10, 15)},
+		{"cron across midnight and year", "cron 0 0 * * *", utc(2024, 12, 31, 23, 30), utc(2025, 1, 1, 0, 0)},
+		{"cron weekdays", "cron 0 9 * * 1-5", utc(2024, 3, 1, 10, 0), utc(2024, 3, 4, 9, 0)},
+		{"cron sunday as 7", "cron 0 0 * * 7", utc(2024, 3, 1, 0, 0), utc(2024, 3, 3, 0, 0)},
+		{"cron day of month or week", "cron 0 0 13 * 5", utc(2024, 9, 1, 0, 0), utc(2024, 9, 6, 0, 0)},
+		{"cron day of month and any week", "cron 0 0 13 * *", utc(2024, 9, 1, 0, 0), utc(2024, 9, 13, 0, 0)},
+		{"cron february 30 or monday", "cron 0 0 30 2 1", utc(2024, 1, 1, 12, 0), utc(2024, 2, 5, 0, 0)},
+		{"cron leap day", "cron 0 0 29 2 *", utc(2024, 3, 1, 0, 0), utc(2028, 2, 29, 0, 0)},
+		{"cron time zone", "cron 0 9 * * * Europe/Berlin", utc(2024, 1, 1, 9, 0), time.Date(2024, 1, 2, 9, 0, 0, 0, berlin)},
+		{"cron hourly across spring forward", "cron 0 * * * * Europe/Berlin", time.Date(2024, 3, 31, 1, 30, 0, 0, berlin), utc(2024, 3, 31, 1, 0)},
+		{"cron hourly across fall back", "cron 0 * * * * Europe/Berlin", utc(2024, 10, 27, 0, 30), utc(2024, 10, 27, 1, 0)},
+		{"cron hour after fall back", "cron 0 3 * * * Europe/Berlin", utc(2024, 10, 27, 0, 30), utc(2024, 10, 27, 2, 0)},
+		{"cron skipped hour runs next day", "cron 30 2 * * * Europe/Berlin", time.Date(2024, 3, 30, 3, 0, 0, 0, berlin), time.Date(2024, 4, 1, 2, 30, 0, 0, berlin)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := parseSchedule(test.spec)
+			if err != nil {
+				t.Fatalf("parseSchedule(%q): %v", test.spec, err)
+			}
+			if got := schedule.Next(test.after); !got.Equal(test.want) {
+				t.Errorf("%s: Next(%s) = %s, want %s", schedule, test.after, got, test.want)
+			}
+		})
+	}
+}
+
+func TestIntervalRangeNext(t *testing.T) {
+	schedule, err := parseSchedule("45-75")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		if got := schedule.Next(after).Sub(after); got < 45*time.Minute || got > 75*time.Minute {
+			t.Fatalf("Next is %s after the last run, want between 45m and 75m", got)
+		}
+	}
+}
+
+func TestCronNextNeverRuns(t *testing.T) {
+	schedule, err := parseCronSchedule(strings.Fields("0 0 30 2 *"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := schedule.Next(time.Now()); !got.IsZero() {
+		t.Errorf("Next = %s, want the zero time", got)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+)
+
+// Team shares credential profiles and auto-redirect jobs between its members.
+// Teams are stored under team:<name> and their profiles under
+// teamprofile:<team>:<name>. Members refer to a team profile as
+// "<team>/<name>", e.g. /profile use acme/shop.
+//
+// Members hold a team role: viewers can see the team's profiles and jobs,
+// operators can also use them and admins manage the team and its profiles.
+// Team roles only narrow what a member may do; commands still need the
+// member's bot-wide role as well.
+type Team struct {
+	Name    string           `json:"name"`
+	Members map[int64]string `json:"members"`
+}
+
+func teamKey(name string) string {
+	return "team:" + name
+}
+
+func teamProfileKey(team, name string) string {
+	return fmt.Sprintf("teamprofile:%s:%s", team, name)
+}
+
+func (team *Team) role(userID int64) Role {
+	role, _ := parseRole(team.Members[userID])
+	return role
+}
+
+func (team *Team) adminCount() int {
+	count := 0
+	for userID := range team.Members {
+		if team.role(userID) == roleAdmin {
+			count++
+		}
+	}
+	return count
+}
+
+// isValidTeamRole reports whether role can be held inside a team.
+func isValidTeamRole(role Role) bool {
+	return role == roleAdmin || role == roleOperator || role == roleViewer
+}
+
+// splitProfileRef splits a profile reference into its team, empty for
+// personal profiles, and the profile name.
+func splitProfileRef(ref string) (string, string) {
+	if team, name, found := strings.Cut(ref, "/"); found {
+		return team, name
+	}
+	return "", ref
+}
+
+func isValidProfileRef(ref string) bool {
+	team, name := splitProfileRef(ref)
+	if team != "" && !isValidProfileName(team) {
+		return false
+	}
+	return isValidProfileName(name)
+}
+
+// profileRecordKey returns the key of the tokens a user refers to with ref.
+func profileRecordKey(userID int64, ref string) string {
+	if team, name := splitProfileRef(ref); team != "" {
+		return teamProfileKey(team, name)
+	}
+	return profileKey(userID, ref)
+}
+
+func getTeam(name string) (*Team, error) {
+	var team Team
+	err := db.View(func(tx *buntdb.Tx) error {
+		value, err := tx.Get(teamKey(name))
+		if err == buntdb.ErrNotFound {
+			return fmt.Errorf("team %q does not exist", name)
+		} else if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(value), &team)
+	})
+	return &team, err
+}
+
+func saveTeam(team *Team) error {
+	jsonTeam, err := json.Marshal(team)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(teamKey(team.Name), string(jsonTeam), nil)
+		return err
+	})
+}
+
+// teamRole returns the role of userID in the team, roleNone for non-members
+// and unknown teams.
+func teamRole(name string, userID int64) Role {
+	team, err := getTeam(name)
+	if err != nil {
+		return roleNone
+	}
+	return team.role(userID)
+}
+
+// profileRole returns the role userID has on the profile ref. Users fully
+// control their personal profiles.
+func profileRole(userID int64, ref string) Role {
+	team, _ := splitProfileRef(ref)
+	if team == "" {
+		return roleOwner
+	}
+	return teamRole(team, userID)
+}
+
+// canAccessJob reports whether userID may use a job of ownerID running on
+// profile with the given role, either as its owner or as a team member.
+func canAccessJob(userID, ownerID int64, profile string, required Role) bool {
+	if userID == ownerID {
+		return true
+	}
+	team, _ := splitProfileRef(profile)
+	return team != "" && teamRole(team, userID) >= required
+}
+
+func createTeam(name string, creatorID int64) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Get(teamKey(name)); err == nil {
+			return fmt.Errorf("team %q already exists", name)
+		}
+		jsonTeam, err := json.Marshal(Team{Name: name, Members: map[int64]string{creatorID: roleAdmin.String()}})
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set(teamKey(name), string(jsonTeam), nil)
+		return err
+	})
+}
+
+// deleteTeam removes a team and its profiles. Teams with running jobs cannot
+// be deleted.
+func deleteTeam(name string) error {
+	jobs, err := getAllAutoRedirectJobs()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if team, _ := splitProfileRef(job.Profile); team == name {
+			return fmt.Errorf("job %s is still running on team profile %s, stop it first", job.ID, job.Profile)
+		}
+	}
+
+	return db.Update(func(tx *buntdb.Tx) error {
+		var keys []string
+		err := tx.AscendKeys(teamProfileKey(name, "*"), func(key, value string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range append(keys, teamKey(name)) {
+			if _, err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// setTeamMember adds userID to the team or changes their role.
+func setTeamMember(name string, userID int64, role Role) error {
+	team, err := getTeam(name)
+	if err != nil {
+		return err
+	}
+	if team.role(userID) == roleAdmin && role != roleAdmin && team.adminCount() == 1 {
+		return fmt.Errorf("user %d is the last admin of team %s", userID, name)
+	}
+	team.Members[userID] = role.String()
+	return saveTeam(team)
+}
+
+func removeTeamMember(name string, userID int64) error {
+	team, err := getTeam(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := team.Members[userID]; !ok {
+		return fmt.Errorf("user %d is not a member of team %s", userID, name)
+	}
+	if team.role(userID) == roleAdmin && team.adminCount() == 1 {
+		return fmt.Errorf("user %d is the last admin of team %s", userID, name)
+	}
+	delete(team.Members, userID)
+	return saveTeam(team)
+}
+
+// getUserTeams returns the teams userID is a member of, sorted by name.
+func getUserTeams(userID int64) ([]*Team, error) {
+	var teams []*Team
+	err := db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys("team:*", func(key, value string) bool {
+			var team Team
+			if json.Unmarshal([]byte(value), &team) == nil && team.role(userID) != roleNone {
+				teams = append(teams, &team)
+			}
+			return true
+		})
+	})
+	sort.Slice(teams, func(i, j int) bool { return teams[i].Name < teams[j].Name })
+	return teams, err
+}
+
+func listTeamProfiles(name string) ([]string, error) {
+	var names []string
+	prefix := teamProfileKey(name, "")
+	err := db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys(prefix+"*", func(key, value string) bool {
+			names = append(names, name+"/"+strings.TrimPrefix(key, prefix))
+			return true
+		})
+	})
+	return names, err
+}
+
+// formatTeamMembers lists the members of a team, admins first.
+func formatTeamMembers(team *Team) string {
+	userIDs := make([]int64, 0, len(team.Members))
+	for userID := range team.Members {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Slice(userIDs, func(i, j int) bool {
+		if team.role(userIDs[i]) != team.role(userIDs[j]) {
+			return team.role(userIDs[i]) > team.role(userIDs[j])
+		}
+		return userIDs[i] < userIDs[j]
+	})
+
+	var text strings.Builder
+	text.WriteString(fmt.Sprintf("👥 Members of team %s:\n\n", team.Name))
+	for _, userID := range userIDs {
+		text.WriteString(fmt.Sprintf("- User ID: %d, %s\n", userID, team.role(userID)))
+	}
+	return text.String()
+}
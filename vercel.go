@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// VercelHostingProvider manages the domains of a Vercel project.
+type VercelHostingProvider struct {
+	ProjectID string
+	Token     string
+	ctx       context.Context
+}
+
+func (p *VercelHostingProvider) Name() string {
+	return "vercel"
+}
+
+func (p *VercelHostingProvider) ListDomains() ([]string, error) {
+	url := fmt.Sprintf("%s/v9/projects/%s/domains", vercelAPIURL, p.ProjectID)
+
+	req, _ := http.NewRequestWithContext(p.ctx, "GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+
+	statusCode, body, err := sendWithRetry(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if statusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get Vercel domains: %s", string(body))
+	}
+
+	var result struct {
+		Domains []struct {
+			Name string `json:"name"`
+		} `json:"domains"`
+	}
+	json.Unmarshal(body, &result)
+
+	domains := make([]string, len(result.Domains))
+	for i, domain := range result.Domains {
+		domains[i] = domain.Name
+	}
+
+	return domains, nil
+}
+
+func (p *VercelHostingProvider) AddDomain(newDomain string) error {
+	url := fmt.Sprintf("%s/v9/projects/%s/domains", vercelAPIURL, p.ProjectID)
+
+	payload := map[string]string{
+		"name": newDomain,
+	}
+	jsonPayload, _ := json.Marshal(payload)
+
+	req, _ := http.NewRequestWithContext(p.ctx, "POST", url, bytes.NewBuffer(jsonPayload))
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	statusCode, body, err := sendWithRetry(req)
+	if err != nil {
+		return err
+	}
+
+	if statusCode == http.StatusConflict {
+		return fmt.Errorf("failed to add Vercel domain: %w: %s", errDomainTaken, string(body))
+	}
+	if statusCode != http.StatusOK {
+		return fmt.Errorf("failed to add Vercel domain: %s", string(body))
+	}
+
+	return nil
+}
+
+func (p *VercelHostingProvider) RemoveDomain(domain string) error {
+	domains, err := p.ListDomains()
+	if err != nil {
+		return fmt.Errorf("failed to get current domains: %v", err)
+	}
+
+	if len(domains) <= 1 {
+		return fmt.Errorf("cannot delete the last remaining domain")
+	}
+
+	url := fmt.Sprintf("%s/v9/projects/%s/domains/%s", vercelAPIURL, p.ProjectID, domain)
+
+	req, _ := http.NewRequestWithContext(p.ctx, "DELETE", url, nil)
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+
+	statusCode, body, err := sendWithRetry(req)
+	if err != nil {
+		return err
+	}
+
+	if statusCode != http.StatusOK {
+		return fmt.Errorf("failed to delete Vercel domain: %s", string(body))
+	}
+
+	return nil
+}
+
+func (p *VercelHostingProvider) BaseDomain() string {
+	return "vercel.app"
+}
+
+func (p *VercelHostingProvider) KeepsGeneratedDomains() bool {
+	return true
+}
+
+// CheckCredentials verifies that the token is valid and, if a project ID is
+// set, that the project is visible to it.
+func (p *VercelHostingProvider) CheckCredentials() error {
+	req, _ := http.NewRequestWithContext(p.ctx, "GET", vercelAPIURL+"/v2/user", nil)
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+
+	statusCode, body, err := sendWithRetry(req)
+	if err != nil {
+		return fmt.Errorf("could not reach Vercel to check the token: %v", err)
+	}
+	switch statusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("the Vercel token is invalid, expired or revoked")
+	default:
+		return fmt.Errorf("unexpected response from Vercel while checking the token (status code %d): %s", statusCode, string(body))
+	}
+
+	if p.ProjectID == "" {
+		return nil
+	}
+
+	req, _ = http.NewRequestWithContext(p.ctx, "GET", fmt.Sprintf("%s/v9/projects/%s", vercelAPIURL, p.ProjectID), nil)
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+
+	statusCode, body, err = sendWithRetry(req)
+	if err != nil {
+		return fmt.Errorf("could not reach Vercel to check the project: %v", err)
+	}
+	switch statusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("no Vercel project with ID %q is visible to this token; check the project ID in the project settings, and for a team project that the token was created for that team", p.ProjectID)
+	case http.StatusForbidden:
+		return fmt.Errorf("the Vercel token is not allowed to access project %q; create a token with access to the team that owns it", p.ProjectID)
+	default:
+		return fmt.Errorf("unexpected response from Vercel while checking the project (status code %d): %s", statusCode, string(body))
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Telegram only accepts secret tokens made of these characters.
+var webhookSecretPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+const webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// startUpdates returns the channel updates are read from and a function that
+// stops receiving them. The bot uses a webhook when WEBHOOK_URL is set and
+// long polling otherwise.
+func startUpdates(bot *tgbotapi.BotAPI) (tgbotapi.UpdatesChannel, func(), error) {
+	webhookURL := os.Getenv("WEBHOOK_URL")
+	if webhookURL == "" {
+		// getUpdates is refused while a webhook is registered, e.g. after
+		// switching back from webhook mode.
+		if _, err := bot.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+			return nil, nil, fmt.Errorf("error removing webhook: %v", err)
+		}
+
+		u := tgbotapi.NewUpdate(0)
+		u.Timeout = 60
+		return bot.GetUpdatesChan(u), bot.StopReceivingUpdates, nil
+	}
+
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if !webhookSecretPattern.MatchString(secret) {
+		return nil, nil, fmt.Errorf("WEBHOOK_SECRET must be 1-256 characters of A-Z, a-z, 0-9, _ and -")
+	}
+	listenAddr := os.Getenv("WEBHOOK_LISTEN_ADDR")
+	if listenAddr == "" {
+		listenAddr = ":8080"
+		if port := os.Getenv("PORT"); port != "" {
+			listenAddr = ":" + port
+		}
+	}
+	return startWebhook(bot, webhookURL, secret, listenAddr)
+}
+
+func startWebhook(bot *tgbotapi.BotAPI, webhookURL, secret, listenAddr string) (tgbotapi.UpdatesChannel, func(), error) {
+	parsedURL, err := url.Parse(webhookURL)
+	if err != nil || parsedURL.Scheme != "https" || parsedURL.Host == "" {
+		return nil, nil, fmt.Errorf("WEBHOOK_URL must be a valid https URL")
+	}
+	path := parsedURL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	updates := make(chan tgbotapi.Update, bot.Buffer)
+	// stopping is closed when the webhook is being removed. Handlers waiting
+	// for room in updates give up then, since nobody reads it anymore.
+	stopping := make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(webhookSecretHeader)), []byte(secret)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		update, err := bot.HandleUpdate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		select {
+		case updates <- *update:
+		case <-stopping:
+			// Telegram delivers the update again after the restart.
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		case <-r.Context().Done():
+		}
+	})
+	server := &http.Server{Addr: listenAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Webhook server failed: ", err)
+		}
+	}()
+
+	params := tgbotapi.Params{}
+	params.AddNonEmpty("url", webhookURL)
+	params.AddNonEmpty("secret_token", secret)
+	params.AddNonEmpty("allowed_updates", `["message"]`)
+	if _, err := bot.MakeRequest("setWebhook", params); err != nil {
+		server.Close()
+		return nil, nil, fmt.Errorf("error registering webhook: %v", err)
+	}
+	log.Printf("[INFO] Webhook registered at %s, listening on %s", webhookURL, listenAddr)
+
+	stop := func() {
+		if _, err := bot.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+			log.Printf("[ERROR] Failed to remove webhook: %v", err)
+		}
+		close(stopping)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// updates is only closed once Shutdown has seen every handler return,
+		// otherwise a handler that is still running could send on it.
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("[ERROR] Failed to stop webhook server: %v", err)
+			return
+		}
+		close(updates)
+		log.Printf("[INFO] Webhook removed")
+	}
+
+	return updates, stop, nil
+}